@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wvdeutekom/molliebot/schedules"
+)
+
+// Calendars serves the on-call shifts as iCalendar feeds, so people can subscribe to
+// their own shifts or to those of a team in their calendar app.
+// Feeds can only be read with the token in their URL, which is derived from the secret.
+type Calendars struct {
+	// Secret the URL tokens are derived from, changing it invalidates all subscriptions
+	Secret string `mapstructure:"secret"`
+	// URL the bot can be reached at from outside, used for the links sent in slack
+	BaseURL string `mapstructure:"base_url"`
+
+	appContext *AppContext
+	// Guards Secret, which is replaced when it is rotated
+	secretMutex sync.RWMutex
+}
+
+const (
+	calendarPath = "/calendars/"
+	// Shifts in this period around now are in the feeds
+	calendarDaysBack  = 30
+	calendarDaysAhead = 90
+)
+
+func (calendars *Calendars) Setup(appContext *AppContext) {
+	calendars.appContext = appContext
+	appContext.Server.Handle(calendarPath, calendars.handle)
+}
+
+// Enabled reports whether feeds can be served and linked to
+func (calendars *Calendars) Enabled() bool {
+	return calendars.secret() != "" && calendars.BaseURL != ""
+}
+
+// SetSecret replaces the secret the tokens are derived from, which invalidates all subscriptions
+func (calendars *Calendars) SetSecret(secret string) {
+	calendars.secretMutex.Lock()
+	defer calendars.secretMutex.Unlock()
+	calendars.Secret = secret
+}
+
+func (calendars *Calendars) secret() string {
+	calendars.secretMutex.RLock()
+	defer calendars.secretMutex.RUnlock()
+	return calendars.Secret
+}
+
+// UserFeedURL returns the URL of the feed with the shifts of a user of the on-call provider
+func (calendars *Calendars) UserFeedURL(userID string) string {
+	return calendars.feedURL("user", userID)
+}
+
+// TeamFeedURL returns the URL of the feed with the shifts of the schedules matching team
+func (calendars *Calendars) TeamFeedURL(team string) string {
+	return calendars.feedURL("team", strings.ToLower(team))
+}
+
+func (calendars *Calendars) feedURL(kind string, name string) string {
+	return fmt.Sprintf("%s%s%s/%s.ics?token=%s", strings.TrimRight(calendars.BaseURL, "/"), calendarPath, kind, url.PathEscape(name), calendars.token(kind, name))
+}
+
+func (calendars *Calendars) token(kind string, name string) string {
+	mac := hmac.New(sha256.New, []byte(calendars.secret()))
+	mac.Write([]byte(kind + ":" + name))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// handle serves /calendars/user/<user ID>.ics and /calendars/team/<team>.ics
+func (calendars *Calendars) handle(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, calendarPath), "/", 2)
+	if len(parts) != 2 || (parts[0] != "user" && parts[0] != "team") || !strings.HasSuffix(parts[1], ".ics") {
+		http.NotFound(w, r)
+		return
+	}
+	kind := parts[0]
+	name := strings.TrimSuffix(parts[1], ".ics")
+
+	if calendars.secret() == "" || !hmac.Equal([]byte(r.URL.Query().Get("token")), []byte(calendars.token(kind, name))) {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	from := now.AddDate(0, 0, -calendarDaysBack)
+	until := now.AddDate(0, 0, calendarDaysAhead)
+
+	var shifts []schedules.Shift
+	var err error
+	var calendarName string
+	if kind == "user" {
+		// Not ListUserShifts, shifts cut off at from would get a different UID every day
+		shifts, err = calendars.appContext.Schedule.ListShifts(from, until)
+		shifts = userShifts(shifts, name)
+		calendarName = "My on-call shifts"
+	} else {
+		shifts, err = calendars.appContext.Schedule.ListTeamShifts(name, from, until)
+		calendarName = "On call: " + name
+	}
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"kind": kind, "name": name}).Warn("Could not list the shifts of a calendar")
+		http.Error(w, "the on-call schedules are unreachable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(formatCalendar(calendarName, shifts, kind == "user", now)))
+}
+
+func userShifts(shifts []schedules.Shift, userID string) []schedules.Shift {
+	var filteredShifts []schedules.Shift
+	for _, shift := range shifts {
+		if shift.User.ID == userID {
+			filteredShifts = append(filteredShifts, shift)
+		}
+	}
+	return filteredShifts
+}
+
+// formatCalendar returns shifts as an iCalendar (RFC 5545) document.
+// Personal calendars name the schedule of a shift, team calendars the person on call.
+func formatCalendar(name string, shifts []schedules.Shift, personal bool, now time.Time) string {
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//molliebot//on-call//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + escapeCalendarText(name),
+	}
+
+	for _, shift := range shifts {
+		summary := shift.User.Summary + " on call for " + shift.Schedule.Summary
+		if personal {
+			summary = "On call for " + shift.Schedule.Summary
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%s-%s-%d@molliebot", shift.Schedule.ID, shift.User.ID, shift.Start.Unix()),
+			"DTSTAMP:"+formatCalendarTime(now),
+			"DTSTART:"+formatCalendarTime(shift.Start),
+			"DTEND:"+formatCalendarTime(shift.End),
+			"SUMMARY:"+escapeCalendarText(summary),
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var calendar string
+	for _, line := range lines {
+		calendar = calendar + foldCalendarLine(line) + "\r\n"
+	}
+	return calendar
+}
+
+func formatCalendarTime(date time.Time) string {
+	return date.In(time.UTC).Format("20060102T150405Z")
+}
+
+func escapeCalendarText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+// foldCalendarLine splits lines longer than 75 bytes, continuation lines start with a space
+func foldCalendarLine(line string) string {
+	var folded string
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// Don't split a multi-byte character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		folded = folded + line[:cut] + "\r\n "
+		line = line[cut:]
+		// The leading space counts as well
+		limit = 74
+	}
+	return folded + line
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/wvdeutekom/molliebot/helpers"
+)
+
+// How often the config file is checked for changes. The file is polled instead of watched,
+// kubernetes updates a mounted ConfigMap by swapping a symlink, which file watchers easily miss.
+const configPollInterval = 30 * time.Second
+
+// reloadableConfig are the parts of the config that are applied without a restart
+type reloadableConfig struct {
+	Lunch struct {
+		Lunches []Lunch `mapstructure:"lunches"`
+	} `mapstructure:"lunch"`
+	Messages struct {
+		Channels          []string `mapstructure:"restricted_channels"`
+		NotificationTimes []string `mapstructure:"notification_times"`
+	} `mapstructure:"messages"`
+	Pagerduty struct {
+		ReportChannels []string `mapstructure:"report_channels"`
+	} `mapstructure:"pagerduty"`
+}
+
+// watchConfig reloads the lunches, restricted channels, report channels and notification times when the config file changes.
+// Other changes need a restart.
+func (context *AppContext) watchConfig() {
+
+	lastContent, err := ioutil.ReadFile(context.ConfigLocation)
+	if err != nil {
+		logrus.WithError(err).Warn("Not watching the config file for changes")
+		return
+	}
+	lastHash := sha256.Sum256(lastContent)
+
+	for range time.Tick(configPollInterval) {
+		content, err := ioutil.ReadFile(context.ConfigLocation)
+		if err != nil {
+			logrus.WithError(err).Warn("Could not read the config file, keeping the current config")
+			continue
+		}
+
+		hash := sha256.Sum256(content)
+		if hash == lastHash {
+			continue
+		}
+		lastHash = hash
+
+		if err := context.reloadConfig(content); err != nil {
+			logrus.WithError(err).Warn("Not reloading the changed config file, keeping the current config")
+		}
+	}
+}
+
+// reloadConfig validates the config in content and swaps the reloadable parts of the running config for it
+func (context *AppContext) reloadConfig(content []byte) error {
+
+	configViper := viper.New()
+	configViper.SetConfigType(strings.TrimPrefix(filepath.Ext(context.ConfigLocation), "."))
+	if err := configViper.ReadConfig(bytes.NewReader(content)); err != nil {
+		return err
+	}
+	// Environment variables and flags keep overriding the file
+	if problems := bindSettings(configViper, context.flags); len(problems) > 0 {
+		return fmt.Errorf("invalid environment variables or flags:\n%s", strings.Join(problems, "\n"))
+	}
+
+	var config reloadableConfig
+	if err := configViper.Unmarshal(&config); err != nil {
+		return err
+	}
+
+	if problems := checkConfig(context.ConfigLocation, content); len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n%s", formatProblems(problems))
+	}
+
+	context.reloadMutex.Lock()
+	defer context.reloadMutex.Unlock()
+
+	// Reschedule the notifications before anything is swapped, so a failure leaves the current config in place
+	logConfigDiff("messages.notification_times", context.Message.GetNotificationTimes(), config.Messages.NotificationTimes)
+	if err := context.Job.Reschedule(lunchNotificationsJob, config.Messages.NotificationTimes); err != nil {
+		return err
+	}
+
+	logConfigDiff("lunch.lunches", lunchStrings(context.Lunch.Lunches), lunchStrings(config.Lunch.Lunches))
+	logConfigDiff("messages.restricted_channels", context.Message.Channels, config.Messages.Channels)
+	logConfigDiff("pagerduty.report_channels", context.Schedule.GetReportChannels(), config.Pagerduty.ReportChannels)
+
+	context.Lunch.Replace(config.Lunch.Lunches)
+	context.Message.SetChannels(config.Messages.Channels, config.Messages.NotificationTimes)
+	context.Schedule.SetReportChannels(config.Pagerduty.ReportChannels)
+
+	logrus.Info("Reloaded the config file")
+	return nil
+}
+
+// logConfigDiff logs the values that were added to and removed from a setting
+func logConfigDiff(setting string, oldValues []string, newValues []string) {
+
+	var added, removed []string
+	for _, value := range newValues {
+		if !helpers.ArrayContainsString(oldValues, value) {
+			added = append(added, value)
+		}
+	}
+	for _, value := range oldValues {
+		if !helpers.ArrayContainsString(newValues, value) {
+			removed = append(removed, value)
+		}
+	}
+
+	if len(added) > 0 {
+		logrus.WithFields(logrus.Fields{"setting": setting, "added": strings.Join(added, ", ")}).Info("Config changed")
+	}
+	if len(removed) > 0 {
+		logrus.WithFields(logrus.Fields{"setting": setting, "removed": strings.Join(removed, ", ")}).Info("Config changed")
+	}
+}
+
+func lunchStrings(lunches []Lunch) []string {
+	var lunchStrings []string
+	for _, lunch := range lunches {
+		lunchStrings = append(lunchStrings, lunch.DateString+" "+lunch.Description)
+	}
+	return lunchStrings
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Run with -race: looking up channels must not write the config that a reload reads and swaps
+func TestReloadWhileReading(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "molliebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := writeTestConfig(t, dir, "bot", "xoxb-bot", "C3", "")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = []byte(strings.Replace(string(content), `["C3"]`, `["C3", "C1", "C2"]`, 1))
+	ioutil.WriteFile(file, content, 0600)
+
+	config, err := LoadConfig([]string{"--config", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	context, err := NewAppContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := []byte(strings.Replace(string(content), `["C3", "C1", "C2"]`, `["C2", "C4"]`, 1))
+
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 50; j++ {
+				context.Message.IsConfigChannel("C2")
+				context.Schedule.IsReportChannel("C2")
+			}
+		}()
+	}
+	for j := 0; j < 10; j++ {
+		next := reloaded
+		if j%2 == 1 {
+			next = content
+		}
+		if err := context.reloadConfig(next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait.Wait()
+
+	if !context.Message.IsConfigChannel("C1") || !context.Message.IsConfigChannel("C3") || context.Message.IsConfigChannel("C4") {
+		t.Errorf("got channels %v after reloading", context.Message.Channels)
+	}
+	if context.Message.Channels[0] != "C3" {
+		t.Errorf("the channels were reordered to %v", context.Message.Channels)
+	}
+}
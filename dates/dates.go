@@ -2,6 +2,7 @@ package dates
 
 import (
 	"fmt"
+	"regexp"
 	"time"
 )
 
@@ -42,3 +43,60 @@ func IsDateToday(date time.Time) bool {
 
 	return isToday
 }
+
+var (
+	tomorrowRegex    = regexp.MustCompile(`\btomorrow\b|\bmorgen\b`)
+	thisWeekendRegex = regexp.MustCompile(`\b(this|dit)\b\s+\bweekend\b`)
+	thisWeekRegex    = regexp.MustCompile(`\b(this|deze)\b\s+\bweek\b`)
+	nextWeekRegex    = regexp.MustCompile(`\b(next|volgende)\b\s+\bweek\b`)
+	dateRegex        = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+)
+
+// DateRange is a period of whole days. From is inclusive, Until is exclusive.
+type DateRange struct {
+	From  time.Time
+	Until time.Time
+}
+
+// Days returns the start of every day in the range
+func (dateRange DateRange) Days() []time.Time {
+	var days []time.Time
+	for day := dateRange.From; day.Before(dateRange.Until); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+// ParseDateRange looks for a period like 'tomorrow', 'this weekend', 'next week' or '2017-05-08' in text.
+// The boolean is false when text does not contain a period.
+func ParseDateRange(text string, now time.Time) (DateRange, bool) {
+
+	today := StartOfDay(now)
+
+	// Days since monday, time.Weekday starts counting at sunday
+	daysSinceMonday := (int(today.Weekday()) + 6) % 7
+	monday := today.AddDate(0, 0, -daysSinceMonday)
+
+	switch {
+	case dateRegex.MatchString(text):
+		date, err := time.ParseInLocation("2006-01-02", dateRegex.FindString(text), now.Location())
+		if err != nil {
+			return DateRange{}, false
+		}
+		return DateRange{date, date.AddDate(0, 0, 1)}, true
+	case tomorrowRegex.MatchString(text):
+		return DateRange{today.AddDate(0, 0, 1), today.AddDate(0, 0, 2)}, true
+	case thisWeekendRegex.MatchString(text):
+		return DateRange{monday.AddDate(0, 0, 5), monday.AddDate(0, 0, 7)}, true
+	case thisWeekRegex.MatchString(text):
+		return DateRange{monday, monday.AddDate(0, 0, 7)}, true
+	case nextWeekRegex.MatchString(text):
+		return DateRange{monday.AddDate(0, 0, 7), monday.AddDate(0, 0, 14)}, true
+	}
+	return DateRange{}, false
+}
+
+// StartOfDay returns midnight of the day of date, in the location of date
+func StartOfDay(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+}
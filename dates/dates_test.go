@@ -0,0 +1,55 @@
+package dates
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateRange(t *testing.T) {
+
+	// Wednesday
+	now := time.Date(2017, 12, 20, 15, 30, 0, 0, time.UTC)
+	day := func(month time.Month, day int) time.Time {
+		return time.Date(2017, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		text  string
+		ok    bool
+		from  time.Time
+		until time.Time
+	}{
+		{"who is on call tomorrow", true, day(12, 21), day(12, 22)},
+		{"wie heeft er morgen dienst", true, day(12, 21), day(12, 22)},
+		{"on call this weekend", true, day(12, 23), day(12, 25)},
+		{"dienst dit weekend", true, day(12, 23), day(12, 25)},
+		{"on call this week", true, day(12, 18), day(12, 25)},
+		{"on call next week", true, day(12, 25), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"on call volgende week", true, day(12, 25), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"on call on 2017-12-24", true, day(12, 24), day(12, 25)},
+		{"on call on 2017-13-45", false, time.Time{}, time.Time{}},
+		{"who is on call", false, time.Time{}, time.Time{}},
+		{"on call for the weekend team", false, time.Time{}, time.Time{}},
+	}
+
+	for _, test := range tests {
+		dateRange, ok := ParseDateRange(test.text, now)
+		if ok != test.ok {
+			t.Errorf("%q: got ok %t, expected %t", test.text, ok, test.ok)
+			continue
+		}
+		if !dateRange.From.Equal(test.from) || !dateRange.Until.Equal(test.until) {
+			t.Errorf("%q: got %s until %s, expected %s until %s", test.text, dateRange.From, dateRange.Until, test.from, test.until)
+		}
+	}
+}
+
+func TestParseDateRangeOnSunday(t *testing.T) {
+
+	// The week starts on monday, so 'this week' on a sunday is the week that ends today
+	now := time.Date(2017, 12, 24, 9, 0, 0, 0, time.UTC)
+	dateRange, ok := ParseDateRange("this week", now)
+	if !ok || !dateRange.From.Equal(time.Date(2017, 12, 18, 0, 0, 0, 0, time.UTC)) || len(dateRange.Days()) != 7 {
+		t.Errorf("got %+v, expected monday 2017-12-18 and 7 days", dateRange)
+	}
+}
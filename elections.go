@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Elections makes sure only one replica of the bot runs the scheduled jobs and answers messages,
+// so two bots running during a rolling update don't both post. The replica holding the lease is the leader,
+// it renews the lease every third of LeaseSeconds and releases it when it is stopped, so the next replica takes over right away.
+// Without a backend every replica is the leader.
+type Elections struct {
+	// Where the lease is kept: kubernetes (a coordination.k8s.io Lease) or file. Disabled when empty.
+	Backend string `mapstructure:"backend"`
+	// Name of the kubernetes Lease, molliebot by default
+	LeaseName string `mapstructure:"lease_name"`
+	// Namespace of the kubernetes Lease, the namespace of the pod by default
+	Namespace string `mapstructure:"namespace"`
+	// Lease file of the file backend, for replicas on one machine or a shared volume
+	LockFile string `mapstructure:"lock_file"`
+	// How long the lease lasts without being renewed, 15 seconds by default
+	LeaseSeconds int `mapstructure:"lease_seconds"`
+
+	identity string
+	store    leaseStore
+	// The lease is held until leaderUntil, unless it is lost or released before that
+	leaderUntil time.Time
+	mutex       sync.RWMutex
+	// Held while taking or releasing the lease, so it is not taken again after Stop
+	campaignMutex sync.Mutex
+	stopped       bool
+}
+
+// leaseStore takes and releases the lease
+type leaseStore interface {
+	// tryAcquire takes or renews the lease for identity, and reports whether identity holds it
+	tryAcquire(identity string, duration time.Duration) (bool, error)
+	release(identity string) error
+}
+
+const (
+	defaultLeaseName    = "molliebot"
+	defaultLeaseSeconds = 15
+	serviceAccountPath  = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+func (elections *Elections) Setup() error {
+
+	elections.identity, _ = os.Hostname()
+	if elections.identity == "" {
+		elections.identity = fmt.Sprintf("molliebot-%d", os.Getpid())
+	}
+	if elections.LeaseName == "" {
+		elections.LeaseName = defaultLeaseName
+	}
+	if elections.LeaseSeconds <= 0 {
+		elections.LeaseSeconds = defaultLeaseSeconds
+	}
+
+	switch elections.Backend {
+	case "":
+		return nil
+	case "kubernetes":
+		store, err := newKubernetesLeaseStore(elections.Namespace, elections.LeaseName)
+		if err != nil {
+			return fmt.Errorf("leader election: %v", err)
+		}
+		elections.store = store
+	case "file":
+		elections.store = &fileLeaseStore{path: elections.LockFile}
+	default:
+		return fmt.Errorf("leader election: unknown backend '%s', use kubernetes or file", elections.Backend)
+	}
+	return nil
+}
+
+// IsLeader reports whether this replica should run the jobs and answer messages
+func (elections *Elections) IsLeader() bool {
+	if elections.store == nil {
+		return true
+	}
+	elections.mutex.RLock()
+	defer elections.mutex.RUnlock()
+	return time.Now().Before(elections.leaderUntil)
+}
+
+// Run keeps taking or renewing the lease until Stop
+func (elections *Elections) Run() {
+
+	if elections.store == nil {
+		return
+	}
+
+	duration := time.Duration(elections.LeaseSeconds) * time.Second
+	for elections.campaign(duration) {
+		time.Sleep(duration / 3)
+	}
+}
+
+// Stop releases the lease and stops taking it, so the next replica takes over right away
+func (elections *Elections) Stop() {
+
+	if elections.store == nil {
+		return
+	}
+
+	elections.campaignMutex.Lock()
+	defer elections.campaignMutex.Unlock()
+	elections.stopped = true
+
+	elections.mutex.Lock()
+	elections.leaderUntil = time.Time{}
+	elections.mutex.Unlock()
+
+	if err := elections.store.release(elections.identity); err != nil {
+		logrus.WithError(err).Warn("Could not release the leader lease")
+	}
+}
+
+// campaign takes or renews the lease, it returns false once the elections are stopped
+func (elections *Elections) campaign(duration time.Duration) bool {
+
+	elections.campaignMutex.Lock()
+	defer elections.campaignMutex.Unlock()
+	if elections.stopped {
+		return false
+	}
+
+	// The lease is counted from before the request, the store may have renewed it any time after
+	start := time.Now()
+	leader, err := elections.store.tryAcquire(elections.identity, duration)
+	if err != nil {
+		// Stay the leader until the lease runs out, the next attempt may succeed
+		logrus.WithError(err).Warn("Could not renew the leader lease")
+		return true
+	}
+
+	elections.mutex.Lock()
+	defer elections.mutex.Unlock()
+
+	wasLeader := start.Before(elections.leaderUntil)
+	if leader {
+		elections.leaderUntil = start.Add(duration)
+	} else {
+		elections.leaderUntil = time.Time{}
+	}
+
+	if leader && !wasLeader {
+		logrus.WithField("identity", elections.identity).Info("This replica is the leader now, running the jobs and answering messages")
+	} else if !leader && wasLeader {
+		logrus.WithField("identity", elections.identity).Info("This replica is not the leader anymore")
+	}
+	return true
+}
+
+// leaseExpired reports whether a lease renewed at renewTime has run out
+func leaseExpired(renewTime time.Time, seconds int, now time.Time) bool {
+	return renewTime.Add(time.Duration(seconds) * time.Second).Before(now)
+}
+
+// fileLeaseStore keeps the lease in a JSON file, for replicas on one machine or a shared volume.
+// The lease is only read and written while holding a lock file, which only one replica can create,
+// so two replicas taking an expired lease at the same moment can't both get it.
+type fileLeaseStore struct {
+	path string
+}
+
+// A lock file older than this was left behind by a replica that crashed, it is removed
+const staleLockAge = 10 * time.Second
+
+type fileLease struct {
+	Holder       string    `json:"holder"`
+	RenewTime    time.Time `json:"renew_time"`
+	LeaseSeconds int       `json:"lease_seconds"`
+}
+
+func (store *fileLeaseStore) read() (*fileLease, error) {
+
+	content, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lease fileLease
+	if err := json.Unmarshal(content, &lease); err != nil {
+		// A half written file is treated as no lease
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// lock creates the lock file of the lease, call the returned function to remove it
+func (store *fileLeaseStore) lock() (func(), error) {
+
+	lockPath := store.path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+			// A replica that found it stale at the same moment could remove the next lock as well,
+			// that takes a crash and three replicas trying within milliseconds
+			os.Remove(lockPath)
+		}
+		return nil, fmt.Errorf("%s is locked by another replica", store.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return func() { os.Remove(lockPath) }, nil
+}
+
+func (store *fileLeaseStore) tryAcquire(identity string, duration time.Duration) (bool, error) {
+
+	unlock, err := store.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	current, err := store.read()
+	if err != nil {
+		return false, err
+	}
+	if current != nil && current.Holder != identity && !leaseExpired(current.RenewTime, current.LeaseSeconds, now) {
+		return false, nil
+	}
+
+	content, err := json.Marshal(fileLease{Holder: identity, RenewTime: now, LeaseSeconds: int(duration / time.Second)})
+	if err != nil {
+		return false, err
+	}
+	// Written next to the lease file and renamed, so the lease is never read half written
+	temporaryPath := filepath.Join(filepath.Dir(store.path), fmt.Sprintf(".%s.%s", filepath.Base(store.path), identity))
+	if err := ioutil.WriteFile(temporaryPath, content, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(temporaryPath, store.path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (store *fileLeaseStore) release(identity string) error {
+
+	unlock, err := store.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := store.read()
+	if err != nil || current == nil || current.Holder != identity {
+		return err
+	}
+	return os.Remove(store.path)
+}
+
+// kubernetesLeaseStore keeps the lease in a coordination.k8s.io/v1 Lease, with the service account of the pod.
+// The service account needs to get, create and update leases in the namespace.
+type kubernetesLeaseStore struct {
+	leaseURL   string
+	leasesURL  string
+	name       string
+	namespace  string
+	token      string
+	httpClient *http.Client
+}
+
+type kubernetesLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// Lease times are MicroTime
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func newKubernetesLeaseStore(namespace string, name string) (*kubernetesLeaseStore, error) {
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in kubernetes, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountPath, "token"))
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespaceContent, err := ioutil.ReadFile(filepath.Join(serviceAccountPath, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(namespaceContent))
+	}
+
+	certificate, err := ioutil.ReadFile(filepath.Join(serviceAccountPath, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	certificates := x509.NewCertPool()
+	if !certificates.AppendCertsFromPEM(certificate) {
+		return nil, fmt.Errorf("no certificates in %s", filepath.Join(serviceAccountPath, "ca.crt"))
+	}
+
+	leasesURL := fmt.Sprintf("https://%s:%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", host, port, namespace)
+	return &kubernetesLeaseStore{
+		leaseURL:  leasesURL + "/" + name,
+		leasesURL: leasesURL,
+		name:      name,
+		namespace: namespace,
+		token:     strings.TrimSpace(string(token)),
+		httpClient: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certificates}},
+		},
+	}, nil
+}
+
+// request sends lease as JSON and decodes the response into it, it returns the HTTP status
+func (store *kubernetesLeaseStore) request(method string, url string, lease *kubernetesLease) (int, error) {
+
+	var body bytes.Buffer
+	if method != "GET" {
+		if err := json.NewEncoder(&body).Encode(lease); err != nil {
+			return 0, err
+		}
+	}
+
+	request, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+store.token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := store.httpClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return response.StatusCode, json.NewDecoder(response.Body).Decode(lease)
+	case http.StatusNotFound, http.StatusConflict:
+		// Expected, the lease does not exist yet or another replica changed it first
+		return response.StatusCode, nil
+	}
+	return response.StatusCode, fmt.Errorf("HTTP status %d from %s %s", response.StatusCode, method, url)
+}
+
+func (store *kubernetesLeaseStore) tryAcquire(identity string, duration time.Duration) (bool, error) {
+
+	now := time.Now()
+	var lease kubernetesLease
+	status, err := store.request("GET", store.leaseURL, &lease)
+	if err != nil {
+		return false, err
+	}
+
+	if status == http.StatusNotFound {
+		lease.APIVersion = "coordination.k8s.io/v1"
+		lease.Kind = "Lease"
+		lease.Metadata.Name = store.name
+		lease.Metadata.Namespace = store.namespace
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.LeaseDurationSeconds = int(duration / time.Second)
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		lease.Spec.RenewTime = lease.Spec.AcquireTime
+
+		status, err = store.request("POST", store.leasesURL, &lease)
+		return status == http.StatusCreated || status == http.StatusOK, err
+	}
+
+	if lease.Spec.HolderIdentity != identity {
+		renewTime, _ := time.Parse(kubernetesMicroTime, lease.Spec.RenewTime)
+		if lease.Spec.HolderIdentity != "" && !leaseExpired(renewTime, lease.Spec.LeaseDurationSeconds, now) {
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.AcquireTime = now.UTC().Format(kubernetesMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(duration / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(kubernetesMicroTime)
+
+	// The resourceVersion makes the update fail with a conflict when another replica updated the lease first
+	status, err = store.request("PUT", store.leaseURL, &lease)
+	return status == http.StatusOK, err
+}
+
+func (store *kubernetesLeaseStore) release(identity string) error {
+
+	var lease kubernetesLease
+	status, err := store.request("GET", store.leaseURL, &lease)
+	if err != nil || status != http.StatusOK || lease.Spec.HolderIdentity != identity {
+		return err
+	}
+
+	// An empty holder can be taken by the next replica right away
+	lease.Spec.HolderIdentity = ""
+	_, err = store.request("PUT", store.leaseURL, &lease)
+	return err
+}
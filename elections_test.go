@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaseExpired(t *testing.T) {
+
+	now := time.Date(2017, 12, 24, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		renewTime time.Time
+		seconds   int
+		expired   bool
+	}{
+		{"just renewed", now, 15, false},
+		{"renewed within the lease", now.Add(-14 * time.Second), 15, false},
+		{"ends right now", now.Add(-15 * time.Second), 15, false},
+		{"ran out", now.Add(-16 * time.Second), 15, true},
+		{"never renewed", time.Time{}, 15, true},
+	}
+
+	for _, test := range tests {
+		if expired := leaseExpired(test.renewTime, test.seconds, now); expired != test.expired {
+			t.Errorf("%s: got expired %t", test.name, expired)
+		}
+	}
+}
+
+func TestFileLeaseStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "elections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lease.json")
+	store := &fileLeaseStore{path: path}
+
+	if leader, err := store.tryAcquire("first", 15*time.Second); !leader || err != nil {
+		t.Fatalf("the first replica didn't get a free lease: %t %v", leader, err)
+	}
+	if leader, err := store.tryAcquire("second", 15*time.Second); leader || err != nil {
+		t.Errorf("the second replica got a held lease: %t %v", leader, err)
+	}
+	if leader, err := store.tryAcquire("first", 15*time.Second); !leader || err != nil {
+		t.Errorf("the first replica couldn't renew its lease: %t %v", leader, err)
+	}
+
+	// Only one replica can take the lease while another one is taking it
+	lockPath := path + ".lock"
+	ioutil.WriteFile(lockPath, nil, 0644)
+	if leader, err := store.tryAcquire("first", 15*time.Second); leader || err == nil {
+		t.Errorf("the lease was renewed while it was locked: %t %v", leader, err)
+	}
+	stale := time.Now().Add(-2 * staleLockAge)
+	os.Chtimes(lockPath, stale, stale)
+	store.tryAcquire("first", 15*time.Second)
+	if leader, err := store.tryAcquire("first", 15*time.Second); !leader || err != nil {
+		t.Errorf("a stale lock was not removed: %t %v", leader, err)
+	}
+
+	if err := store.release("second"); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := store.read(); current == nil || current.Holder != "first" {
+		t.Errorf("a replica released a lease it doesn't hold: %+v", current)
+	}
+
+	// An expired lease can be taken over
+	expired, _ := json.Marshal(fileLease{Holder: "first", RenewTime: time.Now().Add(-time.Minute), LeaseSeconds: 15})
+	ioutil.WriteFile(path, expired, 0644)
+	if leader, err := store.tryAcquire("second", 15*time.Second); !leader || err != nil {
+		t.Errorf("the second replica didn't get an expired lease: %t %v", leader, err)
+	}
+	if err := store.release("second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the released lease file still exists")
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Error("the lock file was left behind")
+	}
+}
+
+func TestFileLeaseStoreOneLeader(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "elections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lease.json")
+
+	var wait sync.WaitGroup
+	leaders := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func(identity string) {
+			defer wait.Done()
+			store := &fileLeaseStore{path: path}
+			if leader, _ := store.tryAcquire(identity, 15*time.Second); leader {
+				leaders <- identity
+			}
+		}("replica-" + strconv.Itoa(i))
+	}
+	wait.Wait()
+	close(leaders)
+
+	var count int
+	for range leaders {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("%d replicas took the lease at the same time", count)
+	}
+}
+
+// kubernetesStandIn serves one coordination.k8s.io Lease, updates with an old resourceVersion get a conflict
+type kubernetesStandIn struct {
+	lease   *kubernetesLease
+	version int
+	mutex   sync.Mutex
+}
+
+func (standIn *kubernetesStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var lease kubernetesLease
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/leases/molliebot":
+		if standIn.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(standIn.lease)
+		return
+	case r.Method == "POST" && r.URL.Path == "/leases":
+		json.NewDecoder(r.Body).Decode(&lease)
+		if standIn.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	case r.Method == "PUT" && r.URL.Path == "/leases/molliebot":
+		json.NewDecoder(r.Body).Decode(&lease)
+		if standIn.lease == nil || lease.Metadata.ResourceVersion != standIn.lease.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	standIn.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(standIn.version)
+	standIn.lease = &lease
+	if r.Method == "POST" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(standIn.lease)
+}
+
+func TestKubernetesLeaseStore(t *testing.T) {
+
+	standIn := &kubernetesStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	store := &kubernetesLeaseStore{
+		leaseURL:   server.URL + "/leases/molliebot",
+		leasesURL:  server.URL + "/leases",
+		name:       "molliebot",
+		namespace:  "default",
+		token:      "test-token",
+		httpClient: &http.Client{},
+	}
+
+	if leader, err := store.tryAcquire("first", 15*time.Second); !leader || err != nil {
+		t.Fatalf("the first replica didn't create the lease: %t %v", leader, err)
+	}
+	if standIn.lease.Spec.HolderIdentity != "first" || standIn.lease.Spec.LeaseDurationSeconds != 15 || standIn.lease.Metadata.Namespace != "default" {
+		t.Errorf("got lease %+v", standIn.lease)
+	}
+	if leader, err := store.tryAcquire("second", 15*time.Second); leader || err != nil {
+		t.Errorf("the second replica got a held lease: %t %v", leader, err)
+	}
+	if leader, err := store.tryAcquire("first", 15*time.Second); !leader || err != nil {
+		t.Errorf("the first replica couldn't renew its lease: %t %v", leader, err)
+	}
+
+	// The holder is cleared on release, and the next replica takes over right away
+	if err := store.release("second"); err != nil || standIn.lease.Spec.HolderIdentity != "first" {
+		t.Errorf("a replica released a lease it doesn't hold: %v", err)
+	}
+	if err := store.release("first"); err != nil || standIn.lease.Spec.HolderIdentity != "" {
+		t.Errorf("the lease was not released: %v", err)
+	}
+	if leader, err := store.tryAcquire("second", 15*time.Second); !leader || err != nil {
+		t.Errorf("the second replica didn't get a released lease: %t %v", leader, err)
+	}
+	if standIn.lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("got %d lease transitions", standIn.lease.Spec.LeaseTransitions)
+	}
+
+	// An expired lease is taken over
+	standIn.lease.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(kubernetesMicroTime)
+	if leader, err := store.tryAcquire("first", 15*time.Second); !leader || err != nil {
+		t.Errorf("the first replica didn't get an expired lease: %t %v", leader, err)
+	}
+
+	store.token = "wrong-token"
+	if _, err := store.tryAcquire("first", 15*time.Second); err == nil {
+		t.Error("expected an error when kubernetes refuses the request")
+	}
+}
+
+func TestStopElections(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "elections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &fileLeaseStore{path: filepath.Join(dir, "lease.json")}
+
+	elections := &Elections{identity: "first", store: store, LeaseSeconds: 15}
+	elections.campaign(15 * time.Second)
+	if !elections.IsLeader() {
+		t.Fatal("the replica didn't become the leader")
+	}
+
+	elections.Stop()
+	if elections.IsLeader() {
+		t.Error("the replica is still the leader after Stop")
+	}
+	if elections.campaign(15 * time.Second) {
+		t.Error("the replica keeps campaigning after Stop")
+	}
+	if leader, _ := store.tryAcquire("second", 15*time.Second); !leader {
+		t.Error("the next replica can't take the lease after Stop")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wvdeutekom/go-pagerduty"
+	"github.com/wvdeutekom/molliebot/schedules"
+)
+
+// Handovers watches the pagerduty schedules for shift changes.
+// The incoming engineer gets a reminder some hours before their shift starts, and when
+// the shift starts the handover is announced and the outgoing engineer is asked for a handover note.
+type Handovers struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	Channel       string `mapstructure:"channel"`
+	ReminderHours int    `mapstructure:"reminder_hours"`
+
+	// Shifts that have been reminded of, by shift key. Entries are removed once the shift has started or is gone from the schedule.
+	reminded   map[string]bool
+	lastCheck  time.Time
+	appContext *AppContext
+}
+
+func (handovers *Handovers) Setup(appContext *AppContext) {
+	handovers.appContext = appContext
+	handovers.reminded = make(map[string]bool)
+	if handovers.ReminderHours == 0 {
+		handovers.ReminderHours = 4
+	}
+}
+
+// Check sends reminders for shifts starting within ReminderHours and announces the shifts that started since the last check
+func (handovers *Handovers) Check() error {
+
+	now := time.Now()
+	reminderUntil := now.Add(time.Duration(handovers.ReminderHours) * time.Hour)
+
+	// Shifts that started before the bot was running have already been handed over
+	if handovers.lastCheck.IsZero() {
+		handovers.lastCheck = now
+	}
+
+	// On failure lastCheck is not moved, so the shifts that start in the meantime are announced on the next check
+	shifts, err := handovers.appContext.Schedule.ListShifts(handovers.lastCheck, reminderUntil)
+	if err != nil {
+		return fmt.Errorf("could not check for handovers: %v", err)
+	}
+
+	current := make(map[string]bool)
+	for _, shift := range shifts {
+		key := shiftKey(shift)
+		current[key] = true
+
+		switch {
+		case shift.Start.After(handovers.lastCheck) && !shift.Start.After(now):
+			handovers.announceHandover(shift, previousShift(shifts, shift))
+			delete(handovers.reminded, key)
+		case shift.Start.After(now) && !handovers.reminded[key]:
+			if !isContinuation(previousShift(shifts, shift), shift) {
+				handovers.remindIncoming(shift)
+			}
+			handovers.reminded[key] = true
+		}
+	}
+
+	// Shifts that were reminded of but were moved or removed since
+	for key := range handovers.reminded {
+		if !current[key] {
+			delete(handovers.reminded, key)
+		}
+	}
+
+	handovers.lastCheck = now
+	return nil
+}
+
+func (handovers *Handovers) remindIncoming(shift schedules.Shift) {
+
+	slackUserID, ok := handovers.appContext.Identity.SlackUserID(shift.User.ID)
+	if !ok {
+		logrus.WithField("user", shift.User.Summary).Warn("Not reminding a user of their shift, they are not linked to a slack user")
+		return
+	}
+
+	handovers.appContext.Message.SendDirectMessage(fmt.Sprintf("Heads up! Your on-call shift for *%s* starts %s and lasts until %s.",
+		shift.Schedule.Summary, formatShiftTime(shift.Start), formatShiftTime(shift.End)), slackUserID)
+}
+
+func (handovers *Handovers) announceHandover(incoming schedules.Shift, outgoing *schedules.Shift) {
+
+	if isContinuation(outgoing, incoming) {
+		return
+	}
+
+	incomingMention := handovers.mention(incoming.User)
+
+	if handovers.Channel != "" {
+		announcement := fmt.Sprintf("On-call handover for *%s*: %s is on call until %s.", incoming.Schedule.Summary, incomingMention, formatShiftTime(incoming.End))
+		if outgoing != nil {
+			announcement = fmt.Sprintf("On-call handover for *%s*: %s → %s, on call until %s.", incoming.Schedule.Summary, handovers.mention(outgoing.User), incomingMention, formatShiftTime(incoming.End))
+		}
+		handovers.appContext.Message.SendMessage(announcement, handovers.Channel)
+	}
+
+	if outgoing == nil {
+		return
+	}
+
+	slackUserID, ok := handovers.appContext.Identity.SlackUserID(outgoing.User.ID)
+	if !ok {
+		logrus.WithField("user", outgoing.User.Summary).Warn("Not asking a user for a handover note, they are not linked to a slack user")
+		return
+	}
+
+	handovers.appContext.Message.SendDirectMessage(fmt.Sprintf("Your on-call shift for *%s* has ended, thanks! Please write a handover note for %s: "+
+		"open incidents, ongoing issues and anything else they should keep an eye on.", incoming.Schedule.Summary, incomingMention), slackUserID)
+}
+
+func (handovers *Handovers) mention(user pagerduty.APIObject) string {
+	return handovers.appContext.Identity.MentionUser(pagerduty.User{APIObject: user, Name: user.Summary})
+}
+
+// previousShift returns the shift in the same schedule that ends when shift starts
+func previousShift(shifts []schedules.Shift, shift schedules.Shift) *schedules.Shift {
+	for i, candidate := range shifts {
+		if candidate.Schedule.ID == shift.Schedule.ID && candidate.End.Equal(shift.Start) {
+			return &shifts[i]
+		}
+	}
+	return nil
+}
+
+// isContinuation reports whether incoming is a back-to-back shift of the same person, which is not a handover
+func isContinuation(outgoing *schedules.Shift, incoming schedules.Shift) bool {
+	return outgoing != nil && outgoing.User.ID == incoming.User.ID
+}
+
+func shiftKey(shift schedules.Shift) string {
+	return shift.Schedule.ID + shift.User.ID + shift.Start.String()
+}
+
+func formatShiftTime(date time.Time) string {
+	location, _ := time.LoadLocation("Europe/Amsterdam")
+	return date.In(location).Format("Mon 2006-01-02 15:04")
+}
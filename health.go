@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Health serves the kubernetes probes on /healthz and /readyz, and the prometheus metrics on /metrics.
+// The bot is healthy while slack events keep coming in, slack sends a latency report every 30 seconds
+// on a quiet connection. It is ready once the RTM connection is up.
+type Health struct {
+	// /healthz fails when no slack event was received for this long, 0 for the default of 5 minutes
+	MaxEventAgeMinutes int `mapstructure:"max_event_age_minutes"`
+
+	appContext *AppContext
+	connected  bool
+	// The last event while connected, or the start of the bot
+	lastEvent time.Time
+	mutex     sync.Mutex
+}
+
+const defaultMaxEventAge = 5 * time.Minute
+
+type healthStatus struct {
+	Connected           bool    `json:"connected"`
+	LastEventSecondsAgo float64 `json:"last_event_seconds_ago"`
+	MaxEventAgeSeconds  float64 `json:"max_event_age_seconds"`
+	Leader              bool    `json:"leader"`
+}
+
+func (health *Health) Setup(appContext *AppContext) {
+	health.appContext = appContext
+	health.lastEvent = time.Now()
+
+	appContext.Server.Handle("/healthz", health.handleHealthz)
+	appContext.Server.Handle("/readyz", health.handleReadyz)
+	appContext.Server.Handle("/metrics", promhttp.Handler().ServeHTTP)
+}
+
+// SetConnected records that the slack RTM connection went up or down
+func (health *Health) SetConnected(connected bool) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.connected = connected
+	if connected {
+		health.lastEvent = time.Now()
+		slackConnected.Set(1)
+	} else {
+		slackConnected.Set(0)
+	}
+}
+
+// EventReceived records an event from slack, events during a reconnect don't count
+func (health *Health) EventReceived() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if health.connected {
+		health.lastEvent = time.Now()
+	}
+}
+
+func (health *Health) maxEventAge() time.Duration {
+	if health.MaxEventAgeMinutes > 0 {
+		return time.Duration(health.MaxEventAgeMinutes) * time.Minute
+	}
+	return defaultMaxEventAge
+}
+
+func (health *Health) status() healthStatus {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return healthStatus{
+		Connected:           health.connected,
+		LastEventSecondsAgo: time.Since(health.lastEvent).Seconds(),
+		MaxEventAgeSeconds:  health.maxEventAge().Seconds(),
+		Leader:              health.appContext.Election.IsLeader(),
+	}
+}
+
+// handleHealthz fails when slack has been quiet for too long, the connection is stuck and a restart should fix it
+func (health *Health) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := health.status()
+	writeHealthStatus(w, status, status.LastEventSecondsAgo <= status.MaxEventAgeSeconds)
+}
+
+// handleReadyz fails until the bot is connected to slack. Replicas that are not the leader are ready too,
+// they take over when the leader goes away.
+func (health *Health) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := health.status()
+	writeHealthStatus(w, status, status.Connected)
+}
+
+func writeHealthStatus(w http.ResponseWriter, status healthStatus, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -2,8 +2,9 @@ package helpers
 
 import (
 	"math/rand"
-	"sort"
+	"strings"
 	"time"
+	"unicode"
 )
 
 func RandomStringFromArray(array []string) string {
@@ -12,12 +13,83 @@ func RandomStringFromArray(array []string) string {
 	return array[rand.Intn(len(array))]
 }
 
+// ArrayContainsString reports whether array contains searchString. It doesn't change array,
+// so it can be called on config that is read by other goroutines.
 func ArrayContainsString(array []string, searchString string) bool {
 
-	sort.Strings(array)
-	i := sort.SearchStrings(array, searchString)
-	if i < len(array) && array[i] == searchString {
-		return true
+	for _, value := range array {
+		if value == searchString {
+			return true
+		}
 	}
 	return false
 }
+
+// FuzzyMatch reports whether query loosely matches name. Casing and punctuation are ignored.
+// The query has to match name from the start of one of its words, like 'pay' for 'Payments' or 'api team' for 'Checkout API Team',
+// or be a small typo away from one of its words. Queries shorter than minPrefixLength only match whole words.
+func FuzzyMatch(query string, name string) bool {
+
+	query = normalize(query)
+	if query == "" {
+		return false
+	}
+
+	// Allow one typo per four characters, so 'paymnets' still matches 'payments'
+	maxDistance := len(query) / 4
+	words := strings.FieldsFunc(strings.ToLower(name), isSeparator)
+	for i, word := range words {
+		if word == query || levenshtein(query, word) <= maxDistance {
+			return true
+		}
+		if len(query) >= minPrefixLength && strings.HasPrefix(strings.Join(words[i:], ""), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// minPrefixLength is the shortest query that matches the start of a word, so 'me' doesn't match 'Merchants'
+const minPrefixLength = 3
+
+func normalize(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), isSeparator), "")
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// levenshtein returns the number of single character edits needed to turn a into b
+func levenshtein(a string, b string) int {
+
+	aRunes, bRunes := []rune(a), []rune(b)
+	previous := make([]int, len(bRunes)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(aRunes); i++ {
+		current := make([]int, len(bRunes)+1)
+		current[0] = i
+		for j := 1; j <= len(bRunes); j++ {
+			cost := 1
+			if aRunes[i-1] == bRunes[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(bRunes)]
+}
+
+func minInt(values ...int) int {
+	minimum := values[0]
+	for _, value := range values[1:] {
+		if value < minimum {
+			minimum = value
+		}
+	}
+	return minimum
+}
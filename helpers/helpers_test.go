@@ -0,0 +1,45 @@
+package helpers
+
+import "testing"
+
+func TestFuzzyMatch(t *testing.T) {
+
+	tests := []struct {
+		query    string
+		name     string
+		expected bool
+	}{
+		{"payments", "Payments", true},
+		{"pay", "Payments", true},
+		{"api", "Checkout API", true},
+		{"api team", "Checkout API Team", true},
+		{"checkout-api", "Checkout API", true},
+		{"paymnets", "Payments", true},
+		{"qa", "QA", true},
+		{"qa", "Platform QA", true},
+		{"me", "Payments", false},
+		{"me", "Merchants", false},
+		{"ments", "Payments", false},
+		{"out", "Checkout API", false},
+		{"billing", "Payments", false},
+		{"", "Payments", false},
+		{"!!", "Payments", false},
+	}
+
+	for _, test := range tests {
+		if match := FuzzyMatch(test.query, test.name); match != test.expected {
+			t.Errorf("%q for %q: got %t, expected %t", test.query, test.name, match, test.expected)
+		}
+	}
+}
+
+func TestArrayContainsString(t *testing.T) {
+
+	array := []string{"C3", "C1", "C2"}
+	if !ArrayContainsString(array, "C2") || ArrayContainsString(array, "C4") {
+		t.Error("got the wrong answer")
+	}
+	if array[0] != "C3" || array[1] != "C1" || array[2] != "C2" {
+		t.Errorf("the array was reordered to %v", array)
+	}
+}
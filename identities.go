@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+	"github.com/wvdeutekom/go-pagerduty"
+)
+
+// Identities maps slack users to the users of the on-call provider, and to pagerduty users.
+// When the schedules are not in pagerduty both are kept, incidents and paging always use pagerduty.
+// Users are matched automatically on their email address, the overrides in the config
+// can be used for people who use a different email address in slack and pagerduty or the on-call provider.
+type Identities struct {
+	// Slack user ID -> pagerduty user ID, also used for the on-call schedules when they are in pagerduty
+	Overrides map[string]string `mapstructure:"overrides"`
+	// Slack user ID -> user ID in opsgenie or the rota, for on-call schedules that are not in pagerduty.
+	// The rota uses the lowercase email address as user ID.
+	OnCallOverrides map[string]string `mapstructure:"on_call_overrides"`
+
+	slackToOnCall    map[string]string
+	onCallToSlack    map[string]string
+	slackToPagerduty map[string]string
+	pagerdutyToSlack map[string]string
+	mutex            sync.RWMutex
+	appContext       *AppContext
+}
+
+func (identities *Identities) Setup(appContext *AppContext) {
+	identities.appContext = appContext
+	if err := identities.Refresh(); err != nil {
+		logrus.WithError(err).Warn("Could not map the slack users to on-call users")
+	}
+}
+
+// Refresh rebuilds the identity mappings from the slack, on-call provider and pagerduty user lists
+func (identities *Identities) Refresh() error {
+
+	slackUsers, err := identities.appContext.Message.slackClient().GetUsers()
+	if err != nil {
+		return fmt.Errorf("could not retrieve slack users: %v", err)
+	}
+
+	onCallUsers, err := identities.appContext.Schedule.ListAllUsers()
+	if err != nil {
+		return fmt.Errorf("could not retrieve the users of the on-call schedules: %v", err)
+	}
+
+	pagerdutyUsers := onCallUsers
+	usesPagerduty := identities.appContext.Schedule.UsesPagerduty()
+	if !usesPagerduty {
+		pagerdutyUsers, err = identities.appContext.Schedule.ListPagerdutyUsers()
+		if err != nil {
+			return fmt.Errorf("could not retrieve pagerduty users: %v", err)
+		}
+	}
+
+	slackToOnCall := matchUsers(slackUsers, onCallUsers)
+	slackToPagerduty := matchUsers(slackUsers, pagerdutyUsers)
+
+	// Viper lowercases map keys, slack user IDs are uppercase
+	for slackUserID, pagerdutyUserID := range identities.Overrides {
+		slackToPagerduty[strings.ToUpper(slackUserID)] = strings.ToUpper(pagerdutyUserID)
+		if usesPagerduty {
+			slackToOnCall[strings.ToUpper(slackUserID)] = strings.ToUpper(pagerdutyUserID)
+		}
+	}
+	if !usesPagerduty {
+		// Opsgenie IDs are lowercase, so the user IDs are used as they are
+		for slackUserID, onCallUserID := range identities.OnCallOverrides {
+			slackToOnCall[strings.ToUpper(slackUserID)] = onCallUserID
+		}
+	}
+
+	identities.mutex.Lock()
+	identities.slackToOnCall = slackToOnCall
+	identities.onCallToSlack = reverseMapping(slackToOnCall)
+	identities.slackToPagerduty = slackToPagerduty
+	identities.pagerdutyToSlack = reverseMapping(slackToPagerduty)
+	identities.mutex.Unlock()
+
+	logrus.WithFields(logrus.Fields{"on_call_users": len(slackToOnCall), "pagerduty_users": len(slackToPagerduty)}).Info("Mapped the slack users")
+	return nil
+}
+
+// matchUsers maps the IDs of slack users to the IDs of users with the same email address
+func matchUsers(slackUsers []slack.User, users []pagerduty.User) map[string]string {
+
+	// Index users by email address, pagerduty and slack don't agree on casing
+	userIDs := make(map[string]string)
+	for _, user := range users {
+		userIDs[strings.ToLower(user.Email)] = user.ID
+	}
+
+	slackToUser := make(map[string]string)
+	for _, user := range slackUsers {
+		if user.IsBot || user.Deleted || user.Profile.Email == "" {
+			continue
+		}
+		if userID, ok := userIDs[strings.ToLower(user.Profile.Email)]; ok {
+			slackToUser[user.ID] = userID
+		}
+	}
+	return slackToUser
+}
+
+func reverseMapping(mapping map[string]string) map[string]string {
+	reversed := make(map[string]string)
+	for key, value := range mapping {
+		reversed[value] = key
+	}
+	return reversed
+}
+
+// OnCallUserID returns the user ID in the on-call schedules of a slack user
+func (identities *Identities) OnCallUserID(slackUserID string) (string, bool) {
+	identities.mutex.RLock()
+	defer identities.mutex.RUnlock()
+
+	onCallUserID, ok := identities.slackToOnCall[slackUserID]
+	return onCallUserID, ok
+}
+
+// SlackUserID returns the slack user ID of a user in the on-call schedules
+func (identities *Identities) SlackUserID(onCallUserID string) (string, bool) {
+	identities.mutex.RLock()
+	defer identities.mutex.RUnlock()
+
+	slackUserID, ok := identities.onCallToSlack[onCallUserID]
+	return slackUserID, ok
+}
+
+// PagerdutyUserID returns the pagerduty user ID of a slack user, for incidents, paging and overrides
+func (identities *Identities) PagerdutyUserID(slackUserID string) (string, bool) {
+	identities.mutex.RLock()
+	defer identities.mutex.RUnlock()
+
+	pagerdutyUserID, ok := identities.slackToPagerduty[slackUserID]
+	return pagerdutyUserID, ok
+}
+
+// PagerdutySlackUserID returns the slack user ID of a pagerduty user, e.g. the assignee of an incident
+func (identities *Identities) PagerdutySlackUserID(pagerdutyUserID string) (string, bool) {
+	identities.mutex.RLock()
+	defer identities.mutex.RUnlock()
+
+	slackUserID, ok := identities.pagerdutyToSlack[pagerdutyUserID]
+	return slackUserID, ok
+}
+
+// MentionUser returns a slack mention for a user of the on-call schedules, or their name if they can't be found in slack
+func (identities *Identities) MentionUser(user pagerduty.User) string {
+	if slackUserID, ok := identities.SlackUserID(user.ID); ok {
+		return fmt.Sprintf("<@%s>", slackUserID)
+	}
+	return user.Name
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+)
+
+// Jobs runs the scheduled jobs of the bot. Every job has a name, so it can be listed, run now,
+// paused and resumed in slack ("mollie jobs") and over HTTP (/jobs).
+type Jobs struct {
+	// Time zone of the job schedules, like Europe/Amsterdam. The time zone of the server by default.
+	TimeZone string `mapstructure:"time_zone"`
+	// Job name -> time zone, for jobs that run in another time zone than TimeZone
+	TimeZones map[string]string `mapstructure:"time_zones"`
+	// Token for the /jobs endpoints, sent as 'Authorization: Bearer <token>'. The endpoints are disabled without one.
+	AdminToken string `mapstructure:"admin_token"`
+	// File the last run of every job is kept in, so runs missed while the bot was down can be caught up on
+	HistoryFile string `mapstructure:"history_file"`
+	// Missed runs longer ago than this are not caught up on, 24 hours by default
+	CatchUpHours int `mapstructure:"catch_up_hours"`
+
+	appContext *AppContext
+	cron       *cron.Cron
+	jobs       []*job
+	// Guards cron, jobs and their state
+	mutex sync.Mutex
+	// Set by Stop, no job runs after that
+	stopped bool
+	// The jobs that are running, Stop waits for them
+	runs sync.WaitGroup
+	// Guards HistoryFile, so runs finishing at the same time don't write it at the same time
+	historyMutex sync.Mutex
+}
+
+type job struct {
+	name     string
+	specs    []string
+	location *time.Location
+	schedule cron.Schedule
+	// missedRun is the scheduled time of a run that is caught up on, or the zero time
+	run func(missedRun time.Time) error
+	// Runs missed while the bot was down are caught up on
+	catchUp bool
+
+	paused       bool
+	running      bool
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    error
+}
+
+// jobStatus is a job as it is listed in slack and over HTTP
+type jobStatus struct {
+	Name         string    `json:"name"`
+	Schedule     []string  `json:"schedule"`
+	TimeZone     string    `json:"time_zone"`
+	Paused       bool      `json:"paused"`
+	Running      bool      `json:"running"`
+	LastRun      time.Time `json:"last_run"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+}
+
+// jobHistory is the last run of a job and whether it is paused, as it is kept in the history file
+type jobHistory struct {
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+	Paused       bool          `json:"paused,omitempty"`
+	// The last run that was not triggered by hand, missed runs are counted from here
+	LastScheduledRun time.Time `json:"last_scheduled_run"`
+}
+
+// jobError is a job command that can't be done, with the HTTP status it is answered with
+type jobError struct {
+	status  int
+	message string
+}
+
+// jobSchedule runs at every spec of a job, in the time zone of the job
+type jobSchedule struct {
+	schedules []cron.Schedule
+	location  *time.Location
+}
+
+func (err jobError) Error() string {
+	return err.message
+}
+
+const (
+	jobsPath              = "/jobs"
+	defaultCatchUpHours   = 24
+	catchUpLeaderInterval = 5 * time.Second
+	// Kubernetes kills the pod 30 seconds after asking it to stop
+	jobsStopTimeout = 20 * time.Second
+)
+
+func (jobs *Jobs) Setup(appContext *AppContext) {
+	jobs.appContext = appContext
+	appContext.Server.Handle(jobsPath, jobs.handle)
+	appContext.Server.Handle(jobsPath+"/", jobs.handle)
+}
+
+// Add registers a job that runs run at every cron spec in specs. A job without specs only runs when it is triggered.
+func (jobs *Jobs) Add(name string, specs []string, run func() error) error {
+	return jobs.add(name, specs, false, func(missedRun time.Time) error {
+		return run()
+	})
+}
+
+// AddCatchingUp registers a job like Add, that also runs once after a restart when a run was missed while the bot was down.
+// The missed run gets the time it was scheduled at, so it can tell it is late.
+func (jobs *Jobs) AddCatchingUp(name string, specs []string, run func(missedRun time.Time) error) error {
+	return jobs.add(name, specs, true, run)
+}
+
+func (jobs *Jobs) add(name string, specs []string, catchUp bool, run func(missedRun time.Time) error) error {
+
+	location, err := jobs.location(name)
+	if err != nil {
+		return err
+	}
+	schedule, err := parseJobSchedule(specs, location)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", name, err)
+	}
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	jobs.jobs = append(jobs.jobs, &job{name: name, specs: specs, location: location, schedule: schedule, run: run, catchUp: catchUp})
+	return nil
+}
+
+// Start runs the jobs on their schedules, and catches up on the runs that were missed once this replica is the leader
+func (jobs *Jobs) Start() {
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	jobs.restart()
+	if jobs.HistoryFile != "" {
+		go jobs.catchUp()
+	}
+}
+
+// catchUp runs every job that missed a scheduled run within CatchUpHours once, with the last missed time
+func (jobs *Jobs) catchUp() {
+
+	for !jobs.appContext.Election.IsLeader() {
+		time.Sleep(catchUpLeaderInterval)
+	}
+
+	// Read when this replica became the leader, the previous leader may have run jobs since the start
+	history, err := jobs.readHistory()
+	if err != nil {
+		logrus.WithError(err).Error("Not catching up on missed jobs, could not read the job history")
+		return
+	}
+
+	gracePeriod := time.Duration(defaultCatchUpHours) * time.Hour
+	if jobs.CatchUpHours > 0 {
+		gracePeriod = time.Duration(jobs.CatchUpHours) * time.Hour
+	}
+
+	now := time.Now()
+	jobs.mutex.Lock()
+	var missed []*job
+	var missedRuns []time.Time
+	for _, job := range jobs.jobs {
+		lastRun, ok := history[job.name]
+		if !ok {
+			continue
+		}
+		job.paused = lastRun.Paused
+		if lastRun.LastRun.After(job.lastRun) {
+			job.lastRun = lastRun.LastRun
+			job.lastDuration = lastRun.LastDuration
+			if lastRun.LastError != "" {
+				job.lastError = errors.New(lastRun.LastError)
+			}
+		}
+
+		scheduledRun := lastRun.LastScheduledRun
+		if scheduledRun.IsZero() {
+			// Written before runs triggered by hand were kept apart
+			scheduledRun = lastRun.LastRun
+		}
+
+		// Without a last run the job has never run here, there is nothing to catch up on
+		if !job.catchUp || job.paused || scheduledRun.IsZero() {
+			continue
+		}
+		if missedRun := lastMissedRun(job.schedule, scheduledRun, now); !missedRun.IsZero() && now.Sub(missedRun) <= gracePeriod {
+			missed = append(missed, job)
+			missedRuns = append(missedRuns, missedRun)
+		}
+	}
+	jobs.mutex.Unlock()
+
+	for i, job := range missed {
+		logrus.WithFields(logrus.Fields{"job": job.name, "missed_run": missedRuns[i].Format(time.RFC3339)}).Info("Job missed a run, running it now")
+		jobs.execute(job, missedRuns[i], true)
+	}
+}
+
+// lastMissedRun returns the last time schedule was due after lastRun and not after now, or the zero time
+func lastMissedRun(schedule cron.Schedule, lastRun time.Time, now time.Time) time.Time {
+
+	var missedRun time.Time
+	for next := schedule.Next(lastRun); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		missedRun = next
+	}
+	return missedRun
+}
+
+func (jobs *Jobs) readHistory() (map[string]jobHistory, error) {
+
+	history := make(map[string]jobHistory)
+	content, err := ioutil.ReadFile(jobs.HistoryFile)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return history, json.Unmarshal(content, &history)
+}
+
+// updateHistory changes the history of a job in the history file
+func (jobs *Jobs) updateHistory(name string, update func(*jobHistory)) error {
+
+	jobs.historyMutex.Lock()
+	defer jobs.historyMutex.Unlock()
+
+	history, err := jobs.readHistory()
+	if err != nil {
+		// A broken history is replaced, it would never be read again otherwise
+		history = make(map[string]jobHistory)
+	}
+	jobHistory := history[name]
+	update(&jobHistory)
+	history[name] = jobHistory
+
+	content, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written next to the history file and renamed, so it is never read half written
+	temporaryFile := jobs.HistoryFile + ".tmp"
+	if err := ioutil.WriteFile(temporaryFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporaryFile, jobs.HistoryFile)
+}
+
+// Reschedule replaces the specs of a job, like the lunch notifications when the config is reloaded
+func (jobs *Jobs) Reschedule(name string, specs []string) error {
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	job := jobs.find(name)
+	if job == nil {
+		return fmt.Errorf("there is no job %s", name)
+	}
+	schedule, err := parseJobSchedule(specs, job.location)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", name, err)
+	}
+
+	job.specs = specs
+	job.schedule = schedule
+	if jobs.cron != nil && !jobs.stopped {
+		jobs.restart()
+	}
+	return nil
+}
+
+// restart replaces the cron with one that has the current schedules, the caller must hold the mutex
+func (jobs *Jobs) restart() {
+
+	jobsCron := cron.New()
+	for _, job := range jobs.jobs {
+		job := job
+		jobsCron.Schedule(job.schedule, cron.FuncJob(func() {
+			jobs.executeScheduled(job)
+		}))
+	}
+	jobsCron.Start()
+
+	if jobs.cron != nil {
+		jobs.cron.Stop()
+	}
+	jobs.cron = jobsCron
+}
+
+// Stop stops running the jobs on their schedules, and waits for the running jobs to finish and write their history
+func (jobs *Jobs) Stop() {
+
+	jobs.mutex.Lock()
+	jobs.stopped = true
+	if jobs.cron != nil {
+		jobs.cron.Stop()
+	}
+	jobs.mutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		jobs.runs.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(jobsStopTimeout):
+		logrus.WithField("timeout", jobsStopTimeout).Warn("Stopping while jobs are still running")
+	}
+}
+
+// Trigger runs a job now in the background, also when it is paused. Only the leader runs jobs.
+func (jobs *Jobs) Trigger(name string) error {
+
+	jobs.mutex.Lock()
+	job := jobs.find(name)
+	running := job != nil && job.running
+	jobs.mutex.Unlock()
+
+	if job == nil {
+		return jobError{http.StatusNotFound, fmt.Sprintf("there is no job %s", name)}
+	}
+	if err := jobs.checkLeader(); err != nil {
+		return err
+	}
+	if running {
+		return jobError{http.StatusConflict, fmt.Sprintf("job %s is already running", name)}
+	}
+	go jobs.execute(job, time.Time{}, false)
+	return nil
+}
+
+// Pause stops a job from running on its schedule until it is resumed
+func (jobs *Jobs) Pause(name string) error {
+	return jobs.setPaused(name, true)
+}
+
+// Resume runs a paused job on its schedule again
+func (jobs *Jobs) Resume(name string) error {
+	return jobs.setPaused(name, false)
+}
+
+// setPaused pauses or resumes a job on the leader, and keeps it in the history file for the next leader
+func (jobs *Jobs) setPaused(name string, paused bool) error {
+
+	jobs.mutex.Lock()
+	job := jobs.find(name)
+	jobs.mutex.Unlock()
+
+	if job == nil {
+		return jobError{http.StatusNotFound, fmt.Sprintf("there is no job %s", name)}
+	}
+	if err := jobs.checkLeader(); err != nil {
+		return err
+	}
+	if jobs.HistoryFile != "" {
+		err := jobs.updateHistory(job.name, func(history *jobHistory) {
+			history.Paused = paused
+		})
+		if err != nil {
+			return fmt.Errorf("could not write the job history: %v", err)
+		}
+	}
+
+	jobs.mutex.Lock()
+	job.paused = paused
+	jobs.mutex.Unlock()
+	logrus.WithFields(logrus.Fields{"job": job.name, "paused": paused}).Info("Job paused or resumed")
+	return nil
+}
+
+// checkLeader returns an error on replicas that are not the leader, a job started or paused there would have no effect
+func (jobs *Jobs) checkLeader() error {
+	if !jobs.appContext.Election.IsLeader() {
+		return jobError{http.StatusServiceUnavailable, "this replica is not the leader, try again to reach the leader"}
+	}
+	return nil
+}
+
+// syncPaused reads which jobs are paused from the history file, they may have been paused while another replica was the leader
+func (jobs *Jobs) syncPaused() {
+
+	if jobs.HistoryFile == "" {
+		return
+	}
+	history, err := jobs.readHistory()
+	if err != nil {
+		logrus.WithError(err).Warn("Could not read the job history")
+		return
+	}
+
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	for _, job := range jobs.jobs {
+		if lastRun, ok := history[job.name]; ok {
+			job.paused = lastRun.Paused
+		}
+	}
+}
+
+// SetAdminToken replaces the token of the /jobs endpoints when it is rotated
+func (jobs *Jobs) SetAdminToken(token string) {
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+	jobs.AdminToken = token
+}
+
+// executeScheduled runs a job on its schedule, unless it is paused or another replica is the leader
+func (jobs *Jobs) executeScheduled(job *job) {
+
+	if !jobs.appContext.Election.IsLeader() {
+		return
+	}
+
+	jobs.syncPaused()
+	jobs.mutex.Lock()
+	paused := job.paused
+	jobs.mutex.Unlock()
+
+	if !paused {
+		jobs.execute(job, time.Time{}, true)
+	}
+}
+
+// execute runs a job and records the outcome, a job never runs twice at the same time.
+// Runs triggered by hand are not scheduled, they don't count as the scheduled run they may stand in for.
+func (jobs *Jobs) execute(job *job, missedRun time.Time, scheduled bool) {
+
+	jobs.mutex.Lock()
+	if jobs.stopped {
+		jobs.mutex.Unlock()
+		return
+	}
+	if job.running {
+		logrus.WithField("job", job.name).Warn("Job is still running, skipping this run")
+		jobs.mutex.Unlock()
+		return
+	}
+	job.running = true
+	jobs.runs.Add(1)
+	jobs.mutex.Unlock()
+	defer jobs.runs.Done()
+
+	start := time.Now()
+	err := job.run(missedRun)
+	duration := time.Since(start)
+
+	jobs.mutex.Lock()
+	job.running = false
+	job.lastRun = start
+	job.lastDuration = duration
+	job.lastError = err
+	jobs.mutex.Unlock()
+
+	countJobRun(job.name, start, duration, err)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"job": job.name, "duration": duration}).Error("Job failed")
+	}
+
+	if jobs.HistoryFile != "" {
+		err := jobs.updateHistory(job.name, func(lastRun *jobHistory) {
+			lastRun.LastRun = start
+			if scheduled {
+				lastRun.LastScheduledRun = start
+			}
+			lastRun.LastDuration = duration
+			lastRun.LastError = ""
+			if err != nil {
+				lastRun.LastError = err.Error()
+			}
+		})
+		if err != nil {
+			logrus.WithError(err).Error("Could not write the job history")
+		}
+	}
+}
+
+// Statuses returns every job with its last and next run
+func (jobs *Jobs) Statuses() []jobStatus {
+
+	jobs.syncPaused()
+	jobs.mutex.Lock()
+	defer jobs.mutex.Unlock()
+
+	now := time.Now()
+	var statuses []jobStatus
+	for _, job := range jobs.jobs {
+		status := jobStatus{
+			Name:     job.name,
+			Schedule: job.specs,
+			TimeZone: job.location.String(),
+			Paused:   job.paused,
+			Running:  job.running,
+			LastRun:  job.lastRun.In(job.location),
+		}
+		if !job.lastRun.IsZero() {
+			status.LastDuration = job.lastDuration.String()
+		}
+		if job.lastError != nil {
+			status.LastError = job.lastError.Error()
+		}
+		if !job.paused {
+			status.NextRun = job.schedule.Next(now)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// StatusMessage lists the jobs for slack
+func (jobs *Jobs) StatusMessage() string {
+
+	jobsMessage := "Scheduled jobs:\n"
+	for _, status := range jobs.Statuses() {
+		schedule := strings.Join(status.Schedule, ", ")
+		if schedule == "" {
+			schedule = "not scheduled"
+		}
+		jobsMessage += fmt.Sprintf("*%s* (%s, %s)", status.Name, schedule, status.TimeZone)
+
+		switch {
+		case status.Running:
+			jobsMessage += " running now"
+		case status.Paused:
+			jobsMessage += " paused"
+		case !status.NextRun.IsZero():
+			jobsMessage += " next run " + status.NextRun.Format("Mon 2 Jan 15:04")
+		}
+
+		if !status.LastRun.IsZero() {
+			jobsMessage += fmt.Sprintf(", last run %s took %s", status.LastRun.Format("Mon 2 Jan 15:04"), status.LastDuration)
+			if status.LastError != "" {
+				jobsMessage += " and failed: " + status.LastError
+			}
+		}
+		jobsMessage += "\n"
+	}
+	return jobsMessage
+}
+
+// handle serves GET /jobs, and POST /jobs/<name>/run, /jobs/<name>/pause and /jobs/<name>/resume
+func (jobs *Jobs) handle(w http.ResponseWriter, r *http.Request) {
+
+	jobs.mutex.Lock()
+	token := jobs.AdminToken
+	jobs.mutex.Unlock()
+
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, jobsPath), "/")
+	if path == "" {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs.Statuses())
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	switch parts[1] {
+	case "run":
+		err = jobs.Trigger(parts[0])
+	case "pause":
+		err = jobs.Pause(parts[0])
+	case "resume":
+		err = jobs.Resume(parts[0])
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if jobErr, ok := err.(jobError); ok {
+			status = jobErr.status
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// find returns the job called name, the caller must hold the mutex
+func (jobs *Jobs) find(name string) *job {
+	for _, job := range jobs.jobs {
+		if strings.EqualFold(job.name, name) {
+			return job
+		}
+	}
+	return nil
+}
+
+// location returns the time zone of a job
+func (jobs *Jobs) location(name string) (*time.Location, error) {
+
+	timeZone := jobs.TimeZone
+	// Viper lowercases map keys, job names are lowercase
+	if jobTimeZone, ok := jobs.TimeZones[strings.ToLower(name)]; ok {
+		timeZone = jobTimeZone
+	}
+	if timeZone == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("job %s: unknown time zone '%s'", name, timeZone)
+	}
+	return location, nil
+}
+
+func parseJobSchedule(specs []string, location *time.Location) (cron.Schedule, error) {
+
+	schedule := jobSchedule{location: location}
+	for _, spec := range specs {
+		parsed, err := cron.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid cron spec: %v", spec, err)
+		}
+		schedule.schedules = append(schedule.schedules, parsed)
+	}
+	return schedule, nil
+}
+
+// Next returns the first time one of the specs matches after t, or the zero time when there are none
+func (schedule jobSchedule) Next(t time.Time) time.Time {
+
+	var next time.Time
+	for _, spec := range schedule.schedules {
+		specNext := spec.Next(t.In(schedule.location))
+		if next.IsZero() || specNext.Before(next) {
+			next = specNext
+		}
+	}
+	return next
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseJobSchedule(t *testing.T) {
+
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	// 2017-12-24 11:00 UTC is 12:00 in Amsterdam
+	now := time.Date(2017, 12, 24, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		specs    []string
+		location *time.Location
+		next     time.Time
+		err      string
+	}{
+		{"every 10 minutes", []string{"0 */10 * * * *"}, time.UTC, time.Date(2017, 12, 24, 11, 10, 0, 0, time.UTC), ""},
+		{"earliest of two specs", []string{"0 0 15 * * *", "0 30 13 * * *"}, time.UTC, time.Date(2017, 12, 24, 13, 30, 0, 0, time.UTC), ""},
+		{"in the time zone of the job", []string{"0 0 13 * * *"}, amsterdam, time.Date(2017, 12, 24, 12, 0, 0, 0, time.UTC), ""},
+		{"tomorrow in the time zone of the job", []string{"0 0 12 * * *"}, amsterdam, time.Date(2017, 12, 25, 11, 0, 0, 0, time.UTC), ""},
+		{"no specs", nil, time.UTC, time.Time{}, ""},
+		{"invalid spec", []string{"0 0 12 * * *", "every day"}, time.UTC, time.Time{}, "'every day' is not a valid cron spec"},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseJobSchedule(test.specs, test.location)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if next := schedule.Next(now); !next.Equal(test.next) {
+			t.Errorf("%s: got next run %s, expected %s", test.name, next, test.next)
+		}
+	}
+}
+
+func TestLastMissedRun(t *testing.T) {
+
+	schedule, err := parseJobSchedule([]string{"0 0 11 * * *"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSpecs, _ := parseJobSchedule(nil, time.UTC)
+
+	tests := []struct {
+		name     string
+		lastRun  time.Time
+		now      time.Time
+		expected time.Time
+	}{
+		{"nothing missed", time.Date(2017, 12, 24, 11, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 18, 0, 0, 0, time.UTC), time.Time{}},
+		{"one missed run", time.Date(2017, 12, 23, 11, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 18, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 11, 0, 0, 0, time.UTC)},
+		{"the last of several missed runs", time.Date(2017, 12, 20, 11, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 18, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 11, 0, 0, 0, time.UTC)},
+		{"due right now", time.Date(2017, 12, 23, 11, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 11, 0, 0, 0, time.UTC), time.Date(2017, 12, 24, 11, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if missedRun := lastMissedRun(schedule, test.lastRun, test.now); !missedRun.Equal(test.expected) {
+			t.Errorf("%s: got %s, expected %s", test.name, missedRun, test.expected)
+		}
+	}
+
+	if missedRun := lastMissedRun(noSpecs, time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC), time.Now()); !missedRun.IsZero() {
+		t.Errorf("a job without specs missed a run at %s", missedRun)
+	}
+}
+
+func TestJobsLocation(t *testing.T) {
+
+	if _, err := time.LoadLocation("Europe/Amsterdam"); err != nil {
+		t.Skip("no time zone database:", err)
+	}
+
+	jobs := &Jobs{TimeZone: "Europe/Amsterdam", TimeZones: map[string]string{"on-call-report": "America/New_York", "handover-check": "Mars/Olympus_Mons"}}
+	tests := []struct {
+		name     string
+		expected string
+		err      string
+	}{
+		{"lunch-notifications", "Europe/Amsterdam", ""},
+		{"on-call-report", "America/New_York", ""},
+		{"On-Call-Report", "America/New_York", ""},
+		{"handover-check", "", "unknown time zone 'Mars/Olympus_Mons'"},
+	}
+
+	for _, test := range tests {
+		location, err := jobs.location(test.name)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if location.String() != test.expected {
+			t.Errorf("%s: got time zone %s, expected %s", test.name, location, test.expected)
+		}
+	}
+
+	if location, err := (&Jobs{}).location("on-call-report"); err != nil || location != time.Local {
+		t.Errorf("got time zone %v and error %v without a time zone, expected the local one", location, err)
+	}
+}
+
+// jobsTestContext returns an appContext with a jobs server, that is the leader unless a lease store is set
+func jobsTestContext(historyFile string) *AppContext {
+	appContext := &AppContext{
+		Server:   &Server{},
+		Election: &Elections{},
+		Job:      &Jobs{AdminToken: "test-token", HistoryFile: historyFile},
+	}
+	appContext.Server.Setup()
+	appContext.Job.Setup(appContext)
+	return appContext
+}
+
+func postJob(appContext *AppContext, path string) int {
+	request := httptest.NewRequest("POST", path, nil)
+	request.Header.Set("Authorization", "Bearer test-token")
+	recorder := httptest.NewRecorder()
+	appContext.Job.handle(recorder, request)
+	return recorder.Code
+}
+
+func TestJobCommands(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyFile := filepath.Join(dir, "history.json")
+
+	appContext := jobsTestContext(historyFile)
+	jobs := appContext.Job
+	release := make(chan bool)
+	err = jobs.Add("slow-job", []string{"0 0 11 * * *"}, func() error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := postJob(appContext, "/jobs/no-job/run"); status != http.StatusNotFound {
+		t.Errorf("got status %d running a job that doesn't exist", status)
+	}
+
+	if status := postJob(appContext, "/jobs/slow-job/run"); status != http.StatusAccepted {
+		t.Fatalf("got status %d running the job", status)
+	}
+	for i := 0; i < 100 && !jobs.Statuses()[0].Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := postJob(appContext, "/jobs/slow-job/run"); status != http.StatusConflict {
+		t.Errorf("got status %d running the job while it runs", status)
+	}
+	close(release)
+	for i := 0; i < 100 && jobs.Statuses()[0].Running; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := postJob(appContext, "/jobs/slow-job/pause"); status != http.StatusAccepted {
+		t.Fatalf("got status %d pausing the job", status)
+	}
+	history, err := jobs.readHistory()
+	if err != nil || !history["slow-job"].Paused {
+		t.Errorf("the pause is not in the history file: %v %v", history, err)
+	}
+
+	// Another replica sees the pause in the shared history file, but can't resume it while it is not the leader
+	replica := jobsTestContext(historyFile)
+	replica.Election.store = &fileLeaseStore{path: filepath.Join(dir, "lease.json")}
+	replica.Job.Add("slow-job", []string{"0 0 11 * * *"}, func() error { return nil })
+	if statuses := replica.Job.Statuses(); !statuses[0].Paused {
+		t.Error("the other replica doesn't know the job is paused")
+	}
+	for _, action := range []string{"run", "pause", "resume"} {
+		if status := postJob(replica, "/jobs/slow-job/"+action); status != http.StatusServiceUnavailable {
+			t.Errorf("got status %d for %s on a replica that is not the leader", status, action)
+		}
+	}
+
+	if status := postJob(appContext, "/jobs/slow-job/resume"); status != http.StatusAccepted {
+		t.Fatalf("got status %d resuming the job", status)
+	}
+	if statuses := replica.Job.Statuses(); statuses[0].Paused {
+		t.Error("the other replica doesn't know the job is resumed")
+	}
+}
+
+func TestStopJobs(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appContext := jobsTestContext(filepath.Join(dir, "history.json"))
+	jobs := appContext.Job
+	runs := 0
+	jobs.Add("slow-job", nil, func() error {
+		time.Sleep(50 * time.Millisecond)
+		runs++
+		return nil
+	})
+	jobs.Start()
+
+	jobs.Trigger("slow-job")
+	for i := 0; i < 100 && !jobs.Statuses()[0].Running; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	jobs.Stop()
+
+	history, err := jobs.readHistory()
+	if err != nil || history["slow-job"].LastRun.IsZero() {
+		t.Errorf("Stop didn't wait for the running job to write its history: %v %v", history, err)
+	}
+	jobs.execute(jobs.find("slow-job"), time.Time{}, true)
+	if runs != 1 {
+		t.Errorf("the job ran %d times, expected it not to run after Stop", runs)
+	}
+}
+
+func TestCatchUpIgnoresManualRuns(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	appContext := jobsTestContext(filepath.Join(dir, "history.json"))
+	jobs := appContext.Job
+	jobs.CatchUpHours = 72
+	var missedRuns []time.Time
+	err = jobs.AddCatchingUp("report", []string{"0 0 * * * *"}, func(missedRun time.Time) error {
+		missedRuns = append(missedRuns, missedRun)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last scheduled run was two hours ago, it was run by hand since
+	lastScheduledRun := time.Now().Add(-2 * time.Hour)
+	jobs.updateHistory("report", func(history *jobHistory) {
+		history.LastRun = lastScheduledRun
+		history.LastScheduledRun = lastScheduledRun
+	})
+	jobs.execute(jobs.find("report"), time.Time{}, false)
+	missedRuns = nil
+
+	jobs.catchUp()
+	if len(missedRuns) != 1 || missedRuns[0].IsZero() {
+		t.Fatalf("got runs %v, expected the missed run to be caught up on", missedRuns)
+	}
+	history, _ := jobs.readHistory()
+	if !history["report"].LastScheduledRun.After(lastScheduledRun) {
+		t.Error("the caught up run is not recorded as the last scheduled run")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+)
+
+// Logs configures the structured log of the bot. Everything is logged as logfmt or JSON lines on stdout,
+// also the lines of the log package and the slack client, with phone numbers and email addresses redacted.
+type Logs struct {
+	// logfmt or json, logfmt by default
+	Format string `mapstructure:"format"`
+	// debug, info, warn or error, info by default. messages.verbose_logging logs at debug.
+	Level string `mapstructure:"level"`
+}
+
+var (
+	// International numbers, 10 digit numbers starting with 0, Dutch mobile numbers like 06-12345678 and numbers like 555-123-4567
+	phoneNumberRegex  = regexp.MustCompile(`\+\d[\d ()-]{6,}\d|\b0\d{9}\b|\b06[ -]?\d{4} ?\d{4}\b|\b\d{3}[ .-]\d{3}[ .-]\d{4}\b`)
+	emailAddressRegex = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// setupLogging applies the logging section of config to the log of the whole process, main calls it once before the bot is built
+func setupLogging(config *Config) error {
+
+	logs := &Logs{}
+	if err := config.viper.UnmarshalKey("logging", logs); err != nil {
+		return fmt.Errorf("unable to decode the logging settings, %v", err)
+	}
+	if config.viper.GetBool("messages.verbose_logging") {
+		logs.Level = "debug"
+	}
+	if err := logs.Setup(); err != nil {
+		return err
+	}
+	logrus.AddHook(redactHook{})
+	return nil
+}
+
+// Setup applies the format and level
+func (logs *Logs) Setup() error {
+
+	switch logs.Format {
+	case "", "logfmt":
+		logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true, FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("'%s' is not a log format, use logfmt or json", logs.Format)
+	}
+
+	if logs.Level != "" {
+		level, err := logrus.ParseLevel(logs.Level)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(level)
+	}
+
+	// Libraries that use the log package log at info, the slack client logs its debug output
+	log.SetFlags(0)
+	log.SetOutput(logrus.StandardLogger().WriterLevel(logrus.InfoLevel))
+	slack.SetLogger(log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0))
+	return nil
+}
+
+// messageLog returns the log of a slack message, with its channel, sender and timestamp as event ID
+func messageLog(msg *slack.MessageEvent) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"channel":  msg.Channel,
+		"user":     msg.User,
+		"event_id": msg.Timestamp,
+	})
+}
+
+// redactHook removes phone numbers and email addresses from the messages and fields that are logged.
+// The fields are redacted in a copy, an entry and its fields can be logged by several goroutines at the same time.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact(entry.Message)
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			data[key] = redact(value)
+		case error:
+			data[key] = redact(value.Error())
+		default:
+			data[key] = value
+		}
+	}
+	entry.Data = data
+	return nil
+}
+
+func redact(text string) string {
+	text = phoneNumberRegex.ReplaceAllString(text, "[phone number]")
+	return emailAddressRegex.ReplaceAllString(text, "[email address]")
+}
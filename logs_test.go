@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"call +31 20 240 4000 now", "call [phone number] now"},
+		{"call +31 (0)6-12345678", "call [phone number]"},
+		{"call +1 555-123-4567", "call [phone number]"},
+		{"call 0612345678", "call [phone number]"},
+		{"call 06 12345678", "call [phone number]"},
+		{"call 06-12345678", "call [phone number]"},
+		{"call 06 1234 5678", "call [phone number]"},
+		{"call 020 240 4000 or 0202404000", "call [phone number] or [phone number]"},
+		{"call 555-123-4567 or 555.123.4567", "call [phone number] or [phone number]"},
+		{"mail alice@example.com", "mail [email address]"},
+		{"mail bob.smith+oncall@mail.example.co.uk", "mail [email address]"},
+		{"lunch on 2017-12-24 at 12:30", "lunch on 2017-12-24 at 12:30"},
+		{"incident #1234 in message 1513252345.000123", "incident #1234 in message 1513252345.000123"},
+		{"job took 1m2.5s", "job took 1m2.5s"},
+	}
+
+	for _, test := range tests {
+		if redacted := redact(test.text); redacted != test.expected {
+			t.Errorf("got %q for %q, expected %q", redacted, test.text, test.expected)
+		}
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+
+	parent := logrus.WithFields(logrus.Fields{
+		"user":     "alice@example.com",
+		"error":    errors.New("could not call 06-12345678"),
+		"attempts": 3,
+	})
+	// logrus fires the hooks on a copy of the entry that is logged, which shares its fields
+	entry := *parent
+	entry.Message = "Paging alice@example.com at 06 12345678"
+
+	if err := (redactHook{}).Fire(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Message != "Paging [email address] at [phone number]" {
+		t.Errorf("got message %q", entry.Message)
+	}
+	if entry.Data["user"] != "[email address]" || entry.Data["error"] != "could not call [phone number]" || entry.Data["attempts"] != 3 {
+		t.Errorf("got fields %v", entry.Data)
+	}
+	if parent.Data["user"] != "alice@example.com" {
+		t.Errorf("the fields of the logged entry were changed to %v", parent.Data)
+	}
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	"github.com/grsmv/goweek"
+	"github.com/sirupsen/logrus"
 	"github.com/wvdeutekom/molliebot/dates"
 	"github.com/wvdeutekom/molliebot/helpers"
 )
@@ -41,6 +42,9 @@ var (
 
 type Lunches struct {
 	Lunches []Lunch `mapstructure:"lunches"`
+
+	// Guards Lunches, which are replaced when the config is reloaded
+	mutex sync.RWMutex
 }
 
 // TODO: Dirty DateString solution, if you  manage to unmarshal this struct
@@ -51,8 +55,8 @@ type Lunch struct {
 	Description string `mapstructure:"description"`
 }
 
-func (lunch *Lunches) Setup() {
-	appContext.Lunch.ConvertLunchStringsToDate()
+func (lunches *Lunches) Setup() {
+	lunches.ConvertLunchStringsToDate()
 }
 
 func (lunches *Lunches) ConvertLunchStringsToDate() {
@@ -61,6 +65,17 @@ func (lunches *Lunches) ConvertLunchStringsToDate() {
 	}
 }
 
+// Replace swaps the lunches for those of a reloaded config
+func (lunches *Lunches) Replace(newLunches []Lunch) {
+	for i := 0; i < len(newLunches); i++ {
+		newLunches[i].DateTime = dates.StringToDate(newLunches[i].DateString, dates.StringToDateOptions{})
+	}
+
+	lunches.mutex.Lock()
+	defer lunches.mutex.Unlock()
+	lunches.Lunches = newLunches
+}
+
 // GetLunchMessageOfToday Get the lunch message today.
 // If introduction is set to true then a short introduction message will be prepended
 func (lunches *Lunches) GetLunchMessageOfToday(introduction bool) string {
@@ -82,6 +97,8 @@ func (lunches *Lunches) GetLunchMessageOfToday(introduction bool) string {
 }
 
 func (lunches *Lunches) getLunchOfToday() *Lunch {
+	lunches.mutex.RLock()
+	defer lunches.mutex.RUnlock()
 
 	for _, lunch := range lunches.Lunches {
 		if dates.IsDateToday(lunch.DateTime) {
@@ -118,9 +135,12 @@ func (lunches *Lunches) getLunchOfThisWeek() []Lunch {
 
 	week, err := goweek.NewWeek(time.Now().ISOWeek())
 	if err != nil {
-		log.Fatal("could not create NewWeek")
+		logrus.WithError(err).Fatal("Could not create the week of the lunches")
 	}
 
+	lunches.mutex.RLock()
+	defer lunches.mutex.RUnlock()
+
 	// Loop over each weekday
 	// This should be refactored so its done only once and stored in a struct
 	var lunchesThisWeek []Lunch
@@ -2,13 +2,17 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/nlopes/slack"
-	"github.com/robfig/cron"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/wvdeutekom/molliebot/dates"
 	"github.com/wvdeutekom/molliebot/schedules"
 )
 
@@ -16,108 +20,309 @@ type AppContext struct {
 	Message        *Messages         `mapstructure:"messages"`
 	Lunch          *Lunches          `mapstructure:"lunch"`
 	Schedule       *schedules.Client `mapstructure:"pagerduty"`
+	Identity       *Identities       `mapstructure:"identities"`
+	Handover       *Handovers        `mapstructure:"handovers"`
+	Topic          *Topics           `mapstructure:"topics"`
+	Page           *Pages            `mapstructure:"pages"`
+	Swap           *Swaps            `mapstructure:"swaps"`
+	Server         *Server           `mapstructure:"http"`
+	Webhook        *Webhooks         `mapstructure:"webhooks"`
+	Calendar       *Calendars        `mapstructure:"calendars"`
+	Secret         *Secrets          `mapstructure:"secrets"`
+	Job            *Jobs             `mapstructure:"jobs"`
+	Election       *Elections        `mapstructure:"leader_election"`
+	Health         *Health           `mapstructure:"health"`
+	Log            *Logs             `mapstructure:"logging"`
 	Options        options
 	ConfigLocation string
+
+	// The parsed command line, applied again when the config file is reloaded
+	flags *pflag.FlagSet
+
+	// Guards the parts of the config that are swapped on reload
+	reloadMutex sync.Mutex
 }
 
 type options struct {
 	DebugMode bool
 }
 
-var (
-	appContext AppContext
-)
+// Config is the config file, with the environment variables and flags that override it
+type Config struct {
+	Location string
+
+	viper *viper.Viper
+	flags *pflag.FlagSet
+}
 
-func init() {
-	// Read config file
-	if appContext.ConfigLocation = os.Getenv("CONFIG_LOCATION"); appContext.ConfigLocation == "" {
-		log.Println("No CONFIG_LOCATION environment variable set. Using default: './config.json'")
-		appContext.ConfigLocation = "./config.json"
+// LoadConfig reads and checks the config file, and binds the environment variables and the flags in args
+func LoadConfig(args []string) (*Config, error) {
+
+	// Flags override the environment variables, which override the config file, see settings.go
+	flags := settingsFlags()
+	if err := flags.Parse(args); err != nil {
+		return nil, err
 	}
+	location := configLocation(flags)
 
-	// TODO: should extract path from configLocation string
-	viper.SetConfigFile(appContext.ConfigLocation)
+	// Refuse to start with a config that would be silently ignored or misread
+	if problems := checkConfigFile(location); len(problems) > 0 {
+		return nil, fmt.Errorf("%s has %d problem(s), run 'molliebot config check %s' after fixing them:\n%s", location, len(problems), location, formatProblems(problems))
+	}
 
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatalf("No configuration file loaded: %v\n", err)
+	config := viper.New()
+	config.SetConfigFile(location)
+	if err := config.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("no configuration file loaded: %v", err)
 	}
 
-	// Read config into appContext struct
-	err = viper.Unmarshal(&appContext)
-	if err != nil {
-		log.Fatalf("unable to decode into struct, %v", err)
+	if problems := bindSettings(config, flags); len(problems) > 0 {
+		return nil, fmt.Errorf("environment variables or flags are invalid:\n%s", strings.Join(problems, "\n"))
 	}
+	return &Config{Location: location, viper: config, flags: flags}, nil
+}
 
-	// Read environment variables
-	// API_KEY
-	var apiToken string
-	if apiToken = os.Getenv("API_KEY"); apiToken == "" {
-		log.Fatalln("No API_KEY environment variable set")
+// configLocation returns the path of the config file, from --config, MOLLIEBOT_CONFIG, CONFIG_LOCATION or './config.json'
+func configLocation(flags *pflag.FlagSet) string {
+	if location, _ := flags.GetString("config"); location != "" {
+		return location
 	}
+	if location := os.Getenv(envPrefix + "CONFIG"); location != "" {
+		return location
+	}
+	if location := os.Getenv("CONFIG_LOCATION"); location != "" {
+		return location
+	}
+	logrus.Info("No CONFIG_LOCATION environment variable set, using the default ./config.json")
+	return "./config.json"
+}
 
-	// DEBUG
-	var debugMode bool
-	debugModeString := os.Getenv("DEBUG")
-	if debugModeString == "" {
-		log.Println("no DEBUG environment variable set. Using default: 'false'")
-		debugMode = false
-	} else {
-		debugMode, err = strconv.ParseBool(debugModeString)
-		if err != nil {
-			log.Fatalln(err)
-		}
+// NewAppContext builds a bot from config. Every section is set up with the appContext it depends on,
+// nothing is started until Run.
+func NewAppContext(config *Config) (*AppContext, error) {
+
+	context := &AppContext{ConfigLocation: config.Location, flags: config.flags}
+	if err := config.viper.Unmarshal(context); err != nil {
+		return nil, fmt.Errorf("unable to decode into struct, %v", err)
 	}
 
-	// Pagerduty
-	viper.BindEnv("PAGERDUTY_API_KEY")
-	pagerdutyApiKey := viper.Get("PAGERDUTY_API_KEY").(string)
+	// These sections are optional
+	if context.Identity == nil {
+		context.Identity = &Identities{}
+	}
+	if context.Handover == nil {
+		context.Handover = &Handovers{}
+	}
+	if context.Topic == nil {
+		context.Topic = &Topics{}
+	}
+	if context.Page == nil {
+		context.Page = &Pages{}
+	}
+	if context.Swap == nil {
+		context.Swap = &Swaps{}
+	}
+	if context.Server == nil {
+		context.Server = &Server{}
+	}
+	if context.Schedule == nil {
+		context.Schedule = &schedules.Client{}
+	}
+	if context.Webhook == nil {
+		context.Webhook = &Webhooks{}
+	}
+	if context.Calendar == nil {
+		context.Calendar = &Calendars{}
+	}
+	if context.Secret == nil {
+		context.Secret = &Secrets{}
+	}
+	if context.Job == nil {
+		context.Job = &Jobs{}
+	}
+	if context.Election == nil {
+		context.Election = &Elections{}
+	}
+	if context.Health == nil {
+		context.Health = &Health{}
+	}
+
+	// Secrets from files and secret stores override the config file
+	if err := context.Secret.Setup(context); err != nil {
+		return nil, fmt.Errorf("could not read the secrets: %v", err)
+	}
+
+	if problems := checkRequiredSettings(context); len(problems) > 0 {
+		return nil, fmt.Errorf("settings are missing:\n%s", strings.Join(problems, "\n"))
+	}
 
-	appContext.Message.Configuration.ApiToken = apiToken
-	appContext.Options.DebugMode = debugMode
-	appContext.Message.Configuration.VerboseLogging = debugMode
-	appContext.Schedule = schedules.New(pagerdutyApiKey, appContext.ConfigLocation)
+	context.Options.DebugMode = context.Message.Configuration.VerboseLogging
+
+	if err := context.Election.Setup(); err != nil {
+		return nil, err
+	}
+
+	if err := context.Schedule.Setup(); err != nil {
+		return nil, err
+	}
+	context.Lunch.Setup()
+	context.Server.Setup()
+	context.Health.Setup(context)
+	context.Message.Setup(context)
+	context.Identity.Setup(context)
+	context.Handover.Setup(context)
+	context.Topic.Setup(context)
+	context.Page.Setup(context)
+	context.Swap.Setup(context)
+	context.Webhook.Setup(context)
+	context.Calendar.Setup(context)
+	context.Job.Setup(context)
+	context.Schedule.FormatUserName = context.Identity.MentionUser
+
+	if err := context.addJobs(); err != nil {
+		return nil, err
+	}
+	return context, nil
 }
 
 func main() {
-	fmt.Println("starting bot")
+	if isConfigCheck() {
+		os.Exit(runConfigCheck(os.Args[3:]))
+	}
+	if isSecretsCommand() {
+		os.Exit(runSecretsCommand(os.Args[2:]))
+	}
+
+	config, err := LoadConfig(os.Args[1:])
+	if err == pflag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		logrus.Fatalf("Refusing to start, %v", err)
+	}
+
+	// The log and the metrics are shared by the whole process, they are set up once here
+	if err := setupLogging(config); err != nil {
+		logrus.Fatalf("Refusing to start, %v", err)
+	}
+	registerMetrics()
 
-	logger := log.New(os.Stdout, "messages-bot: ", log.Lshortfile|log.LstdFlags)
-	slack.SetLogger(logger)
+	appContext, err := NewAppContext(config)
+	if err != nil {
+		logrus.Fatalf("Refusing to start, %v", err)
+	}
 
-	appContext.Lunch.Setup()
-	appContext.Message.Setup(&appContext)
+	// When kubernetes stops the pod the bot disconnects from slack, so Run returns and the bot shuts down
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		logrus.Info("Stopping bot")
+		appContext.Message.Stop()
+	}()
 
-	appContext.startCrons()
-	appContext.Message.Monitor()
+	logrus.Info("Starting bot")
+	appContext.Run()
+	appContext.Stop()
 }
 
-func (context *AppContext) startCrons() {
+// Run starts the leader election, the jobs, the config and secret watchers, the webhook poster and the HTTP server,
+// and answers messages until the bot is stopped or slack rejects the credentials
+func (context *AppContext) Run() {
+	go context.Election.Run()
+	context.Job.Start()
+	go context.watchConfig()
+	go context.Secret.Watch()
+	go context.Webhook.Run()
+	// The bot can answer messages without the HTTP server
+	if err := context.Server.Start(); err != nil {
+		logrus.WithError(err).Error("Could not start the HTTP server, webhooks, calendars, jobs and health checks are unavailable")
+	}
+	context.Message.Monitor()
+}
+
+// Stop shuts the bot down after Run: the HTTP server finishes the requests it is handling, the running jobs finish
+// and write their history, and the leader lease is released so the next replica takes over right away
+func (context *AppContext) Stop() {
+	context.Server.Stop()
+	context.Job.Stop()
+	context.Election.Stop()
+}
+
+// Names of the scheduled jobs
+const (
+	onCallRefreshJob      = "on-call-refresh"
+	identitiesRefreshJob  = "identities-refresh"
+	handoverCheckJob      = "handover-check"
+	onCallReportJob       = "on-call-report"
+	lunchNotificationsJob = "lunch-notifications"
+)
+
+// addJobs registers the scheduled jobs, they run once Run starts them
+func (context *AppContext) addJobs() error {
 
-	cron := cron.New()
+	jobs := context.Job
 
-	cron.AddFunc("0 */10 * * * *", func() {
-		context.Schedule.GetCurrentOnCallUsers()
+	// When pagerduty can't be reached the last known on-call users are kept until the next run
+	err := jobs.Add(onCallRefreshJob, []string{"0 */10 * * * *"}, func() error {
+		if _, err := context.Schedule.GetCurrentOnCallUsers(); err != nil {
+			return fmt.Errorf("could not refresh the on-call users: %v", err)
+		}
+		context.Topic.Sync()
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	err = jobs.Add(identitiesRefreshJob, []string{"0 0 * * * *"}, context.Identity.Refresh)
+	if err != nil {
+		return err
+	}
+
+	if context.Handover.Enabled {
+		err = jobs.Add(handoverCheckJob, []string{"0 */5 * * * *"}, context.Handover.Check)
+		if err != nil {
+			return err
+		}
+	}
 
-	cron.AddFunc("0 1 11 18 * *", func() {
-		reportMessage := context.Schedule.CompileScheduleReport()
+	err = jobs.AddCatchingUp(onCallReportJob, []string{"0 1 11 18 * *"}, func(missedRun time.Time) error {
+		reportMessage, err := context.Schedule.CompileScheduleReport()
+		if err != nil {
+			reportMessage = fmt.Sprintf("I couldn't compile the monthly on-call report. %s is unreachable, ask me for the on-call report when it is back.", context.Schedule.ProviderName())
+		}
+		reportMessage = delayedNote(missedRun) + reportMessage
 
 		// Send message to report_channels
-		for _, reportChannel := range appContext.Schedule.ReportChannels {
+		for _, reportChannel := range context.Schedule.GetReportChannels() {
 			context.Message.SendMessage(reportMessage, reportChannel)
 		}
+		return err
 	})
+	if err != nil {
+		return err
+	}
 
-	for _, cronTime := range context.Message.NotificationTimes {
-		fmt.Println("adding cron ", cronTime)
-		cron.AddFunc(cronTime, func() {
-			lunchMessage := context.Lunch.GetLunchMessageOfToday(true)
+	// Sends the lunch of today to the joined channels, the notification times are replaced when the config is reloaded
+	return jobs.AddCatchingUp(lunchNotificationsJob, context.Message.GetNotificationTimes(), func(missedRun time.Time) error {
+		// The message is about the lunch of today, a notification missed on an earlier day is not sent anymore
+		if !missedRun.IsZero() && !dates.IsDateToday(missedRun.Local()) {
+			logrus.WithField("missed_run", missedRun.Format(time.RFC3339)).Info("Not catching up on the lunch notification of an earlier day")
+			return nil
+		}
+		lunchMessage := delayedNote(missedRun) + context.Lunch.GetLunchMessageOfToday(true)
 
-			joinedChannelIDs := context.Message.GetJoinedChannelsIDs()
-			context.Message.SendMessageToChannels(lunchMessage, joinedChannelIDs)
-		})
+		joinedChannelIDs := context.Message.GetJoinedChannelsIDs()
+		context.Message.SendMessageToChannels(lunchMessage, joinedChannelIDs)
+		return nil
+	})
+}
 
+// delayedNote returns the note for a message that is sent late, because the bot was down when it was due
+func delayedNote(missedRun time.Time) string {
+	if missedRun.IsZero() {
+		return ""
 	}
-	cron.Start()
+	return fmt.Sprintf("_This message is delayed, it was due %s but I was offline._\n", missedRun.Format("Monday 2 January at 15:04"))
 }
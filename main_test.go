@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeTestConfig writes a config file for a bot that reads its schedules from a rota file in dir
+func writeTestConfig(t *testing.T, dir string, name string, token string, channel string, address string) string {
+
+	rotaFile := filepath.Join(dir, name+"-rota.csv")
+	if err := ioutil.WriteFile(rotaFile, []byte("schedule,name,email,phone,start,end\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, name+".json")
+	content := fmt.Sprintf(`{
+  "messages": {"api_token": %q, "restricted_channels": [%q]},
+  "lunch": {"lunches": [{"date": "2017-12-24", "description": "Lunch of %s"}]},
+  "pagerduty": {"provider": "rota", "rota_file": %q},
+  "http": {"address": %q}
+}`, token, channel, name, rotaFile, address)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestTwoAppContexts(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "molliebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A legacy variable applies to both bots, without being copied to MOLLIEBOT_WEBHOOKS_SECRET
+	defer setEnv("PAGERDUTY_WEBHOOK_SECRET", "legacy-secret")()
+	defer setEnv("MOLLIEBOT_WEBHOOKS_SECRET", "")()
+
+	hooks := len(logrus.StandardLogger().Hooks[logrus.InfoLevel])
+	transport := http.DefaultTransport
+
+	var contexts []*AppContext
+	for _, bot := range []struct{ name, token, channel, address string }{
+		{"first", "xoxb-first", "C1", "127.0.0.1:0"},
+		{"second", "xoxb-second", "C2", ""},
+	} {
+		file := writeTestConfig(t, dir, bot.name, bot.token, bot.channel, bot.address)
+		config, err := LoadConfig([]string{"--config", file})
+		if err != nil {
+			t.Fatalf("%s: %v", bot.name, err)
+		}
+		context, err := NewAppContext(config)
+		if err != nil {
+			t.Fatalf("%s: %v", bot.name, err)
+		}
+		contexts = append(contexts, context)
+	}
+	first, second := contexts[0], contexts[1]
+
+	if first.Message.Configuration.ApiToken != "xoxb-first" || second.Message.Configuration.ApiToken != "xoxb-second" {
+		t.Errorf("got slack tokens %q and %q", first.Message.Configuration.ApiToken, second.Message.Configuration.ApiToken)
+	}
+	if !first.Message.IsConfigChannel("C1") || first.Message.IsConfigChannel("C2") || !second.Message.IsConfigChannel("C2") {
+		t.Error("the bots share their channels")
+	}
+	if first.Lunch.Lunches[0].Description != "Lunch of first" || second.Lunch.Lunches[0].Description != "Lunch of second" {
+		t.Error("the bots share their lunches")
+	}
+	if first.Server.Address != "127.0.0.1:0" || second.Server.Address != "" || first.Server.mux == second.Server.mux {
+		t.Error("the bots share their HTTP server")
+	}
+	if first.Job == second.Job || first.Election == second.Election || first.Secret == second.Secret {
+		t.Error("the bots share their jobs, leader election or secrets")
+	}
+
+	if first.Webhook.Secret != "legacy-secret" || second.Webhook.Secret != "legacy-secret" {
+		t.Errorf("got webhook secrets %q and %q from the legacy variable", first.Webhook.Secret, second.Webhook.Secret)
+	}
+	if os.Getenv("MOLLIEBOT_WEBHOOKS_SECRET") != "" {
+		t.Error("the legacy variable was copied to the environment")
+	}
+
+	if len(logrus.StandardLogger().Hooks[logrus.InfoLevel]) != hooks {
+		t.Error("building a bot added log hooks")
+	}
+	if http.DefaultTransport != transport {
+		t.Error("building a bot replaced the default HTTP transport")
+	}
+}
@@ -2,69 +2,160 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+	"github.com/wvdeutekom/molliebot/dates"
 	"github.com/wvdeutekom/molliebot/helpers"
+	"github.com/wvdeutekom/molliebot/schedules"
 )
 
 var (
-	botNameRegex       = regexp.MustCompile(`^\bmollie(bot)?\b|\bmollie(bot)?\??$`)
-	helpRegex          = regexp.MustCompile(`\bhelp\b`)
-	lunchRegex         = regexp.MustCompile(`\blunch\w*|\beten\b|\beat\w*\b`)
-	thisWeekRegex      = regexp.MustCompile(`\b(this|deze)\b\s+\bweek\b`)
-	todayRegex         = regexp.MustCompile(`\bvandaag\b|\btoday\b`)
-	userTagRegex       = regexp.MustCompile(`\<\@(.{9})\>`)
-	goAwayRegex        = regexp.MustCompile(`(\bgo\b\s+\baway\b|\bleave\b|\bfuck\b\s+\boff\b)`)
-	userIdRegex        = regexp.MustCompile(`\<\@|\>`)
-	onCallRegex        = regexp.MustCompile(`\bpagerduty\b|\bon(-| )?call\b`)
-	reportRegex        = regexp.MustCompile(`\breport\b`)
-	directMessageRegex = regexp.MustCompile(`^D(.{8})$`)
+	botNameRegex        = regexp.MustCompile(`^\bmollie(bot)?\b|\bmollie(bot)?\??$`)
+	helpRegex           = regexp.MustCompile(`\bhelp\b`)
+	lunchRegex          = regexp.MustCompile(`\blunch\w*|\beten\b|\beat\w*\b`)
+	thisWeekRegex       = regexp.MustCompile(`\b(this|deze)\b\s+\bweek\b`)
+	todayRegex          = regexp.MustCompile(`\bvandaag\b|\btoday\b`)
+	userTagRegex        = regexp.MustCompile(`\<\@(.{9})\>`)
+	goAwayRegex         = regexp.MustCompile(`(\bgo\b\s+\baway\b|\bleave\b|\bfuck\b\s+\boff\b)`)
+	userIdRegex         = regexp.MustCompile(`\<\@|\>`)
+	onCallRegex         = regexp.MustCompile(`\bpagerduty\b|\bon(-| )?call\b`)
+	reportRegex         = regexp.MustCompile(`\breport\b`)
+	amIOnCallRegex      = regexp.MustCompile(`\bam\b\s+\b(I|i)\b\s+\bon(-| )?call\b`)
+	onCallTeamRegex     = regexp.MustCompile(`\bon(-| )?call\b\s+\b(for|voor|in)\b\s+(\bthe\b\s+|\bteam\b\s+)*([\w-]+)`)
+	openIncidentsRegex  = regexp.MustCompile(`\bincidents\b`)
+	incidentRegex       = regexp.MustCompile(`\bincident\b\s+#?(\d+)`)
+	manageIncidentRegex = regexp.MustCompile(`\b(ack|acknowledge|resolve)\b\s+(\bincident\b\s+)?#?(\d+)`)
+	pageRegex           = regexp.MustCompile(`\bpage\b\s+([\w-]+)\s*(.*)`)
+	confirmPageRegex    = regexp.MustCompile(`\bconfirm\b\s+\bpage\b\s+(\d{4})\b`)
+	swapRegex           = regexp.MustCompile(`\bswap\b\s+\bmy\b\s+(on(-| )?call\s+)?shifts?\b`)
+	answerSwapRegex     = regexp.MustCompile(`\b(accept|decline)\b\s+\bswap\b\s+(\d{4})\b`)
+	fairnessRegex       = regexp.MustCompile(`\bfairness\b`)
+	monthsRegex         = regexp.MustCompile(`\b(\d+)\s+\bmonths?\b`)
+	refreshRegex        = regexp.MustCompile(`\brefresh\b`)
+	calendarRegex       = regexp.MustCompile(`\bcalendar\b(\s+\b(for|voor)\b\s+(\bthe\b\s+|\bteam\b\s+)*([\w-]+))?`)
+	myShiftsRegex       = regexp.MustCompile(`\bmy\b\s+(on(-| )?call\s+)?shifts?\b|\bwhen\b\s+\bam\b\s+\b(I|i)\b\s+\bon(-| )?call\b`)
+	jobsRegex           = regexp.MustCompile(`\bjobs\b`)
+	jobActionRegex      = regexp.MustCompile(`\b(run|pause|resume)\b\s+\bjob\b\s+([\w-]+)`)
+	directMessageRegex  = regexp.MustCompile(`^D(.{8})$`)
 )
 
+// Words that can follow 'on call for' but describe a period instead of a team
+var periodWords = []string{"today", "tomorrow", "this", "next", "vandaag", "morgen", "deze", "dit", "volgende", "weekend"}
+
 type Messages struct {
 	api               *slack.Client
 	Channels          []string `mapstructure:"restricted_channels"`
 	NotificationTimes []string `mapstructure:"notification_times"`
-	Configuration     messagesConfiguration
-	appContext        *AppContext
+	// Slack user IDs that may use admin commands, next to the admins and owners of the slack team
+	Admins        []string              `mapstructure:"admins"`
+	Configuration messagesConfiguration `mapstructure:",squash"`
+	appContext    *AppContext
+	teamDomain    string
+
+	// Guards Channels, NotificationTimes and api, which are replaced when the config is reloaded or the token rotated
+	mutex sync.RWMutex
+	// Makes Monitor connect again after the token was rotated
+	tokenChanged chan struct{}
+	// Makes Monitor disconnect and return
+	stop chan struct{}
 }
 
 type messagesConfiguration struct {
-	VerboseLogging           bool
-	ApiToken                 string
-	RestrictToConfigChannels bool
+	// Logs at debug, with the full debug log of the slack API
+	VerboseLogging bool `mapstructure:"verbose_logging"`
+	// Slack API key
+	ApiToken string `mapstructure:"api_token"`
+	// Only respond in restricted_channels
+	RestrictToConfigChannels bool `mapstructure:"restrict_to_config_channels"`
 }
 
 func (m *Messages) Setup(appContext *AppContext) {
 	m.api = slack.New(m.Configuration.ApiToken)
 	m.api.SetDebug(m.Configuration.VerboseLogging)
 	m.appContext = appContext
+	m.tokenChanged = make(chan struct{}, 1)
+	m.stop = make(chan struct{}, 1)
+}
+
+// SetApiToken swaps the slack client for one with a rotated token, Monitor reconnects with it
+func (m *Messages) SetApiToken(token string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.Configuration.ApiToken = token
+	if m.api == nil {
+		// Not set up yet, Setup uses the new token
+		return
+	}
+	m.api = slack.New(token)
+	m.api.SetDebug(m.Configuration.VerboseLogging)
+
+	select {
+	case m.tokenChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Messages) slackClient() *slack.Client {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.api
 }
 
+// Stop disconnects from slack, Monitor returns once it is disconnected
+func (m *Messages) Stop() {
+	select {
+	case m.stop <- struct{}{}:
+	default:
+	}
+}
+
+// Monitor answers messages until it is stopped or the slack credentials are invalid
 func (m *Messages) Monitor() {
 
-	rtm := m.api.NewRTM()
+	rtm := m.slackClient().NewRTM()
 	go rtm.ManageConnection()
 
 Loop:
 	for {
 		select {
+		case <-m.stop:
+			rtm.Disconnect()
+			m.appContext.Health.SetConnected(false)
+			break Loop
+		case <-m.tokenChanged:
+			rtm.Disconnect()
+			m.appContext.Health.SetConnected(false)
+			rtm = m.slackClient().NewRTM()
+			go rtm.ManageConnection()
 		case msg := <-rtm.IncomingEvents:
+			m.appContext.Health.EventReceived()
 			switch ev := msg.Data.(type) {
 			case *slack.ConnectedEvent:
+				m.appContext.Health.SetConnected(true)
+			case *slack.DisconnectedEvent:
+				m.appContext.Health.SetConnected(false)
 			case *slack.TeamJoinEvent:
 				// Handle new user to client
 			case *slack.MessageEvent: //
 				// Handle new message to channel
 
 				// Only respond to real users. Bots have BotIDs, users do not
+				// Only the leader responds, when more replicas are running
 				if ev.Msg.BotID == "" {
+					messagesReceived.Inc()
+					messageLog(ev).Debug("Message received")
+				}
+				if ev.Msg.BotID == "" && m.appContext.Election.IsLeader() {
 
 					if m.Configuration.RestrictToConfigChannels == true {
-						if helpers.ArrayContainsString(m.Channels, ev.Channel) {
+						if m.IsConfigChannel(ev.Channel) {
 							m.manageResponse(ev)
 						}
 					} else {
@@ -77,9 +168,10 @@ Loop:
 			case *slack.ReactionRemovedEvent:
 				// Handle reaction removed
 			case *slack.RTMError:
-				fmt.Printf("Error: %s\n", ev.Error())
+				logrus.WithError(ev).Error("Slack RTM error")
 			case *slack.InvalidAuthEvent:
-				fmt.Printf("Invalid credentials")
+				logrus.Error("Invalid slack credentials, stopping")
+				m.appContext.Health.SetConnected(false)
 				break Loop
 			default:
 				// fmt.Printf("Unknown error")
@@ -88,10 +180,20 @@ Loop:
 	}
 }
 
+// matchIntent counts and logs a request the bot is answering
+func matchIntent(msg *slack.MessageEvent, intent string) {
+	countIntent(intent)
+	messageLog(msg).WithField("intent", intent).Info("Answering message")
+}
+
 func (m *Messages) manageResponse(msg *slack.MessageEvent) {
 
 	// Get <@U12345> tag(s) from text and convert them to readable names
 	userTags := userTagRegex.FindAllString(msg.Text, -1)
+	var taggedUserIDs []string
+	for _, tag := range userTags {
+		taggedUserIDs = append(taggedUserIDs, userIdRegex.ReplaceAllString(tag, ""))
+	}
 	for _, tag := range userTags {
 		retrievedUsername := m.RetrieveSlackUsername(tag)
 		msg.Text = strings.Replace(msg.Text, tag, retrievedUsername, -1)
@@ -104,6 +206,7 @@ func (m *Messages) manageResponse(msg *slack.MessageEvent) {
 		//Handle help requests
 		// Sentence contains 'help'
 		if helpRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "help")
 			m.SendMessage("Need my help? Ask for lunch by asking along the lines of:\n"+
 				"> Mollie what's for lunch today\n"+
 				"> What are we having for lunch this week mollie\n"+
@@ -112,31 +215,128 @@ func (m *Messages) manageResponse(msg *slack.MessageEvent) {
 				"I can also help you with pagerduty\n"+
 				"> Who is on call Molliebot?\n"+
 				"> Who has pagerduty today Mollie?\n"+
+				"> Who is on call next week Mollie?\n"+
+				"> Mollie who is on call tomorrow / this weekend / on 2017-12-24?\n"+
+				"> Who is on call for payments next week Mollie?\n"+
+				"> Mollie am I on call?\n"+
+				"> Mollie open incidents\n"+
+				"> Mollie incident 1234\n"+
+				"> Mollie ack 1234 / Mollie resolve 1234 (only for incidents assigned to you)\n"+
+				"> Mollie page payments checkout is down\n"+
+				"> Mollie swap my shift on 2017-11-02 with @alice\n"+
+				"> Mollie fairness report 6 months (only in report channels)\n"+
+				"> Mollie when am I on call? (I'll send you a direct message)\n"+
+				"> Mollie my calendar / Mollie calendar for payments (to subscribe to in your calendar app)\n"+
+				"> Mollie jobs / Mollie run job on-call-report / Mollie pause job lunch-notifications (admins only)\n"+
 				"Suggestions, bugs? Create an issue on <https://github.com/wvdeutekom/molliebot|github.com>", msg.Channel)
 		}
 
 		//Handle general requests
 		// Sentence contains 'go' and 'away'
 		if goAwayRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "go_away")
 
 			m.SendMessage(fmt.Sprintf("I'm sorry %v, I'm afraid can't do that", m.RetrieveSlackUsername(msg.User)), msg.Channel)
 		}
 
-		// Handle pagerduty requests
-		// Sentence contains on(-)call/pagerduty
-		if onCallRegex.MatchString(trimmedText) == true {
+		// Handle page requests
+		// Sentence contains 'confirm page 1234' or 'page <service> <what is wrong>'
+		if matches := confirmPageRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "confirm_page")
+			m.appContext.Page.Confirm(msg, matches[1])
+		} else if matches := pageRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "page")
+			m.appContext.Page.Request(msg, matches[1], strings.TrimSpace(matches[2]))
+		}
+
+		// Handle fairness report requests, only in report_channels
+		// Sentence contains 'fairness'
+		if fairnessRegex.MatchString(trimmedText) {
+			matchIntent(msg, "fairness_report")
+			if m.appContext.Schedule.IsReportChannel(msg.Channel) {
+				m.sendFairnessReport(trimmedText, msg.Channel)
+			} else {
+				m.SendMessage("The fairness report is only available in the report channels.", msg.Channel)
+			}
+		}
+
+		// Handle incident requests
+		// Sentence contains 'ack 1234', 'resolve 1234', 'incident 1234' or 'incidents'
+		if matches := manageIncidentRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "manage_incident")
+			m.manageIncident(msg, matches[3], matches[1])
+		} else if matches := incidentRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "incident")
+			incidentMessage, err := m.appContext.Schedule.GetIncidentMessage(matches[1])
+			if schedules.IsNotFound(err) {
+				m.SendMessage(fmt.Sprintf("There is no incident %s.", matches[1]), msg.Channel)
+			} else {
+				m.SendIncidentMessage(incidentMessage, err, msg.Channel)
+			}
+		} else if openIncidentsRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "open_incidents")
+			incidentsMessage, err := m.appContext.Schedule.GetOpenIncidentsMessage()
+			m.SendIncidentMessage(incidentsMessage, err, msg.Channel)
+		}
+
+		// Handle admin requests
+		// Sentence contains 'refresh' and 'on call'/'pagerduty'
+		if refreshRegex.MatchString(trimmedText) && onCallRegex.MatchString(trimmedText) {
+			matchIntent(msg, "refresh_on_call")
+			m.refreshOnCallUsers(msg)
+		}
+
+		// Sentence contains 'run/pause/resume job <name>' or 'jobs'
+		if matches := jobActionRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "manage_job")
+			m.manageJob(msg, matches[1], matches[2])
+		} else if jobsRegex.MatchString(trimmedText) {
+			matchIntent(msg, "jobs")
+			m.sendJobs(msg)
+		}
+
+		// Handle personal pagerduty requests
+		// Sentence contains 'accept/decline swap 1234', 'swap my shift', 'calendar', 'my shifts' or 'when am I on call'
+		if matches := answerSwapRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "answer_swap")
+			m.appContext.Swap.Answer(msg, matches[2], matches[1] == "accept")
+		} else if swapRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "swap")
+			m.requestSwap(msg, trimmedText, taggedUserIDs)
+		} else if matches := calendarRegex.FindStringSubmatch(trimmedText); matches != nil {
+			matchIntent(msg, "calendar")
+			m.sendCalendarLink(msg, matches[4])
+		} else if myShiftsRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "my_shifts")
+			m.sendUpcomingShifts(msg)
+		} else if amIOnCallRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "am_i_on_call")
+			m.sendAmIOnCall(msg)
+		} else if onCallRegex.MatchString(trimmedText) && !fairnessRegex.MatchString(trimmedText) && !refreshRegex.MatchString(trimmedText) {
+			// Handle pagerduty requests
+			// Sentence contains on(-)call/pagerduty
 			// If question comes from report_channels array, return pagerduty report.
-			if (reportRegex.MatchString(trimmedText) && helpers.ArrayContainsString(appContext.Schedule.ReportChannels, msg.Channel)) == true {
-				m.SendMessage(appContext.Schedule.CompileScheduleReport(), msg.Channel)
+			if (reportRegex.MatchString(trimmedText) && m.appContext.Schedule.IsReportChannel(msg.Channel)) == true {
+				matchIntent(msg, "on_call_report")
+				reportMessage, err := m.appContext.Schedule.CompileScheduleReport()
+				m.SendPagerdutyMessage(reportMessage, err, msg.Channel)
+			} else if dateRange, ok := dates.ParseDateRange(trimmedText, time.Now()); ok {
+				matchIntent(msg, "on_call_schedule")
+				// Sentence contains a period like 'tomorrow', 'this weekend', 'next week' or a date
+				onCallMessage, err := m.appContext.Schedule.GetOnCallScheduleMessage(dateRange, m.teamQuery(trimmedText, msg.Channel))
+				m.SendPagerdutyMessage(onCallMessage, err, msg.Channel)
 			} else {
 				// If the user does not/may not ask for a report, then print who is on call right now.
-				m.SendMessage(appContext.Schedule.GetCurrentOnCallUsersMessage(), msg.Channel)
+				matchIntent(msg, "on_call")
+				onCallMessage, err := m.appContext.Schedule.GetCurrentOnCallUsersMessage(m.teamQuery(trimmedText, msg.Channel))
+				m.SendPagerdutyMessage(onCallMessage, err, msg.Channel)
 			}
 		}
 
 		// Handle lunch requests
 		// Sentence contains 'lunch(ing,es)' or 'eten'
 		if lunchRegex.MatchString(trimmedText) == true {
+			matchIntent(msg, "lunch")
 
 			switch {
 
@@ -154,8 +354,228 @@ func (m *Messages) manageResponse(msg *slack.MessageEvent) {
 			}
 		}
 	} else {
-		fmt.Println("NO MATCHES AT ALL")
+		messageLog(msg).Debug("Message is not addressed to the bot")
+	}
+}
+
+// teamQuery returns the team asked for in "who is on call for payments".
+// Without one the team configured for the channel in channel_teams is used, if any.
+func (m *Messages) teamQuery(text string, channelID string) string {
+
+	if matches := onCallTeamRegex.FindStringSubmatch(text); matches != nil {
+		team := matches[len(matches)-1]
+		// "on call for tomorrow" or "on call for next week" is about a period, not a team
+		_, isDate := dates.ParseDateRange(team, time.Now())
+		if !isDate && !helpers.ArrayContainsString(periodWords, strings.ToLower(team)) {
+			return team
+		}
+	}
+
+	return m.appContext.Schedule.TeamForChannel(channelID)
+}
+
+// manageIncident acknowledges or resolves an incident on behalf of the pagerduty user linked to the sender
+func (m *Messages) manageIncident(msg *slack.MessageEvent, incidentNumber string, action string) {
+
+	pagerdutyUserID, ok := m.appContext.Identity.PagerdutyUserID(msg.User)
+	if !ok {
+		m.SendMessage("I don't know who you are in pagerduty. Ask an admin to add you to the identity overrides in my config.", msg.Channel)
+		return
+	}
+
+	status := "acknowledged"
+	if action == "resolve" {
+		status = "resolved"
+	}
+
+	incident, err := m.appContext.Schedule.ManageIncident(incidentNumber, pagerdutyUserID, status)
+	switch {
+	case err == schedules.ErrNotAssigned:
+		m.SendMessage(fmt.Sprintf("Incident %s is not assigned to you, only the assigned responder can %s it.", incidentNumber, action), msg.Channel)
+	case schedules.IsNotFound(err):
+		m.SendMessage(fmt.Sprintf("There is no incident %s.", incidentNumber), msg.Channel)
+	case err != nil:
+		m.SendMessage(fmt.Sprintf("I couldn't update incident %s: %v", incidentNumber, err), msg.Channel)
+	default:
+		m.SendMessage(fmt.Sprintf("%s is now %s by <@%s>.", incident.APIObject.Summary, status, msg.User), msg.Channel)
+	}
+}
+
+// sendFairnessReport sends the on-call fairness report over the last months as a message and a CSV file.
+// The number of months can be given like "fairness report 6 months", the default is 3.
+func (m *Messages) sendFairnessReport(text string, channelID string) {
+
+	months := 3
+	if matches := monthsRegex.FindStringSubmatch(text); matches != nil {
+		months, _ = strconv.Atoi(matches[1])
+	}
+	if months < 1 || months > 24 {
+		m.SendMessage("I can make a fairness report of 1 up to 24 months.", channelID)
+		return
+	}
+
+	report, reportCSV, err := m.appContext.Schedule.CompileFairnessReport(months)
+	m.SendPagerdutyMessage(report, err, channelID)
+	if reportCSV != "" {
+		m.UploadFile(reportCSV, fmt.Sprintf("oncall-fairness-%s.csv", time.Now().Format("2006-01-02")), channelID)
+	}
+}
+
+// refreshOnCallUsers fetches the on-call users from pagerduty right away, for admins only
+func (m *Messages) refreshOnCallUsers(msg *slack.MessageEvent) {
+
+	if !m.IsAdmin(msg.User) {
+		m.SendMessage("Only admins can make me refresh, I'll do it myself in a few minutes.", msg.Channel)
+		return
+	}
+
+	onCallUsers, err := m.appContext.Schedule.GetCurrentOnCallUsers()
+	if err != nil {
+		m.SendPagerdutyMessage("", err, msg.Channel)
+		return
+	}
+	m.SendMessage(fmt.Sprintf("Refreshed! %d people are on call right now.", len(onCallUsers)), msg.Channel)
+}
+
+// sendJobs lists the scheduled jobs, for admins
+func (m *Messages) sendJobs(msg *slack.MessageEvent) {
+
+	if !m.IsAdmin(msg.User) {
+		m.SendMessage("Only admins can see my jobs.", msg.Channel)
+		return
+	}
+	m.SendMessage(m.appContext.Job.StatusMessage(), msg.Channel)
+}
+
+// manageJob handles "run job <name>", "pause job <name>" and "resume job <name>", for admins
+func (m *Messages) manageJob(msg *slack.MessageEvent, action string, name string) {
+
+	if !m.IsAdmin(msg.User) {
+		m.SendMessage("Only admins can manage my jobs.", msg.Channel)
+		return
+	}
+
+	var err error
+	var reply string
+	switch action {
+	case "run":
+		err = m.appContext.Job.Trigger(name)
+		reply = fmt.Sprintf("Running %s now, ask me for my jobs to see how it went.", name)
+	case "pause":
+		err = m.appContext.Job.Pause(name)
+		reply = fmt.Sprintf("Paused %s, it won't run until you resume it.", name)
+	case "resume":
+		err = m.appContext.Job.Resume(name)
+		reply = fmt.Sprintf("Resumed %s.", name)
+	}
+	if err != nil {
+		reply = fmt.Sprintf("I couldn't %s that job: %v", action, err)
+	}
+	m.SendMessage(reply, msg.Channel)
+}
+
+// requestSwap handles "swap my shift on 2017-11-02 with @alice"
+func (m *Messages) requestSwap(msg *slack.MessageEvent, text string, taggedUserIDs []string) {
+
+	dateRange, ok := dates.ParseDateRange(text, time.Now())
+	if !ok || len(taggedUserIDs) == 0 {
+		m.SendMessage("Tell me when and with whom, like: mollie swap my shift on 2017-11-02 with @alice", msg.Channel)
+		return
+	}
+
+	m.appContext.Swap.Request(msg, dateRange, taggedUserIDs[len(taggedUserIDs)-1])
+}
+
+func (m *Messages) sendAmIOnCall(msg *slack.MessageEvent) {
+
+	onCallUserID, ok := m.appContext.Identity.OnCallUserID(msg.User)
+	if !ok {
+		m.SendMessage(fmt.Sprintf("I don't know who you are in %s. Ask an admin to add you to the identity overrides in my config.", m.appContext.Schedule.ProviderName()), msg.Channel)
+		return
+	}
+
+	onCall, err := m.appContext.Schedule.IsUserOnCall(onCallUserID)
+	if err != nil {
+		m.SendPagerdutyMessage("", err, msg.Channel)
+	} else if onCall {
+		m.SendMessage(fmt.Sprintf("Yes <@%s>, you are on call right now. Keep your phone close!", msg.User), msg.Channel)
+	} else {
+		m.SendMessage(fmt.Sprintf("No <@%s>, you are not on call right now.", msg.User), msg.Channel)
+	}
+}
+
+// sendUpcomingShifts sends the on-call shifts of the next four weeks to the user in a direct message
+func (m *Messages) sendUpcomingShifts(msg *slack.MessageEvent) {
+
+	onCallUserID, ok := m.appContext.Identity.OnCallUserID(msg.User)
+	if !ok {
+		m.SendMessage(fmt.Sprintf("I don't know who you are in %s. Ask an admin to add you to the identity overrides in my config.", m.appContext.Schedule.ProviderName()), msg.Channel)
+		return
 	}
+
+	shiftsMessage, err := m.appContext.Schedule.GetUpcomingShiftsMessage(onCallUserID, time.Now().AddDate(0, 0, 28))
+	if err != nil {
+		m.SendPagerdutyMessage("", err, msg.Channel)
+		return
+	}
+	m.SendDirectMessage(shiftsMessage, msg.User)
+}
+
+// sendCalendarLink sends the link to the calendar feed of a team, or the personal feed of the sender as a direct message
+func (m *Messages) sendCalendarLink(msg *slack.MessageEvent, team string) {
+
+	if !m.appContext.Calendar.Enabled() {
+		m.SendMessage("Calendar feeds are not set up, ask an admin to configure `calendars` in my config.", msg.Channel)
+		return
+	}
+
+	if team != "" {
+		m.SendMessage(fmt.Sprintf("Subscribe to this link in your calendar app to see who is on call for %s:\n%s", team, m.appContext.Calendar.TeamFeedURL(team)), msg.Channel)
+		return
+	}
+
+	onCallUserID, ok := m.appContext.Identity.OnCallUserID(msg.User)
+	if !ok {
+		m.SendMessage(fmt.Sprintf("I don't know who you are in %s. Ask an admin to add you to the identity overrides in my config.", m.appContext.Schedule.ProviderName()), msg.Channel)
+		return
+	}
+	m.SendDirectMessage(fmt.Sprintf("Subscribe to this link in your calendar app to see your on-call shifts. Keep it to yourself, anyone with the link can see them:\n%s", m.appContext.Calendar.UserFeedURL(onCallUserID)), msg.User)
+}
+
+// IsConfigChannel reports whether a channel is in the restricted channels of the config
+func (m *Messages) IsConfigChannel(channelID string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return helpers.ArrayContainsString(m.Channels, channelID)
+}
+
+// GetNotificationTimes returns the cron specs of the lunch notifications
+func (m *Messages) GetNotificationTimes() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.NotificationTimes
+}
+
+// SetChannels swaps the restricted channels and notification times for those of a reloaded config
+func (m *Messages) SetChannels(channels []string, notificationTimes []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Channels = channels
+	m.NotificationTimes = notificationTimes
+}
+
+// IsAdmin reports whether a slack user is in the admins of the config or is an admin or owner of the slack team
+func (m *Messages) IsAdmin(userID string) bool {
+	if helpers.ArrayContainsString(m.Admins, userID) {
+		return true
+	}
+
+	user, err := m.slackClient().GetUserInfo(userID)
+	if err != nil {
+		logrus.WithError(err).WithField("user", userID).Warn("Could not look up the slack user")
+		return false
+	}
+	return user.IsAdmin || user.IsOwner
 }
 
 func (m *Messages) RetrieveSlackUsername(userId string) string {
@@ -165,9 +585,9 @@ func (m *Messages) RetrieveSlackUsername(userId string) string {
 		userId = userIdRegex.ReplaceAllString(userId, "")
 	}
 
-	user, error := m.api.GetUserInfo(userId)
+	user, error := m.slackClient().GetUserInfo(userId)
 	if error != nil {
-		log.Print(error)
+		logrus.WithError(error).WithField("user", userId).Warn("Could not look up the slack user")
 	}
 
 	return user.Name
@@ -197,18 +617,18 @@ func (m *Messages) GetJoinedChannelsIDs() []string {
 }
 
 func (m *Messages) retrieveAllChannels() []slack.Channel {
-	channels, error := m.api.GetChannels(true)
+	channels, error := m.slackClient().GetChannels(true)
 	if error != nil {
-		log.Print(error)
+		logrus.WithError(error).Warn("Could not list the slack channels")
 		return nil
 	}
 	return channels
 }
 
 func (m *Messages) retrieveAllGroups() []slack.Group {
-	groups, error := m.api.GetGroups(true)
+	groups, error := m.slackClient().GetGroups(true)
 	if error != nil {
-		log.Print(error)
+		logrus.WithError(error).Warn("Could not list the private slack channels")
 		return nil
 	}
 	return groups
@@ -220,6 +640,29 @@ func (m *Messages) SendMessageToChannels(messageText string, channelIDs []string
 	}
 }
 
+// SendPagerdutyMessage sends a message that was compiled from the data of the on-call provider.
+// If compiling it failed, the user is told the provider can't be reached instead.
+func (m *Messages) SendPagerdutyMessage(messageText string, err error, channelId string) {
+	if err != nil {
+		providerName := m.appContext.Schedule.ProviderName()
+		logrus.WithError(err).WithFields(logrus.Fields{"channel": channelId, "provider": providerName}).Warn("On-call provider request failed")
+		m.SendMessage(fmt.Sprintf("%s is unreachable right now, please try again in a few minutes.", providerName), channelId)
+		return
+	}
+	m.SendMessage(messageText, channelId)
+}
+
+// SendIncidentMessage sends a message that was compiled from pagerduty incidents, which are always in pagerduty
+// whatever the on-call provider is. If compiling it failed, the user is told pagerduty can't be reached instead.
+func (m *Messages) SendIncidentMessage(messageText string, err error, channelId string) {
+	if err != nil {
+		logrus.WithError(err).WithField("channel", channelId).Warn("Pagerduty request failed")
+		m.SendMessage("PagerDuty is unreachable right now, please try again in a few minutes.", channelId)
+		return
+	}
+	m.SendMessage(messageText, channelId)
+}
+
 func (m *Messages) SendMessage(messageText string, channelId string) {
 	params := slack.PostMessageParameters{
 		AsUser: true,
@@ -227,12 +670,100 @@ func (m *Messages) SendMessage(messageText string, channelId string) {
 	footer := randomFooter()
 	messageText += footer
 
-	channelID, timestamp, err := m.api.PostMessage(channelId, messageText, params)
+	channelID, timestamp, err := m.slackClient().PostMessage(channelId, messageText, params)
+	countReply(err)
+	if err != nil {
+		logrus.WithError(err).WithField("channel", channelId).Error("Could not send the message")
+		return
+	}
+	logrus.WithFields(logrus.Fields{"channel": channelID, "timestamp": timestamp}).Debug("Message sent")
+}
+
+// UploadFile shares a file with the given content in a channel
+func (m *Messages) UploadFile(content string, filename string, channelID string) {
+	params := slack.FileUploadParameters{
+		Content:  content,
+		Filename: filename,
+		Title:    filename,
+		Channels: []string{channelID},
+	}
+
+	_, err := m.slackClient().UploadFile(params)
+	countReply(err)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"channel": channelID, "file": filename}).Error("Could not upload the file")
+	}
+}
+
+// PostMessage posts a message without a footer and returns its timestamp.
+// When threadTimestamp is set the message is posted as a reply in that thread.
+func (m *Messages) PostMessage(messageText string, channelID string, threadTimestamp string) (string, error) {
+	params := slack.PostMessageParameters{
+		AsUser:          true,
+		ThreadTimestamp: threadTimestamp,
+	}
+
+	_, timestamp, err := m.slackClient().PostMessage(channelID, messageText, params)
+	countReply(err)
+	return timestamp, err
+}
+
+// UpdateMessage replaces the text of a message that was sent by the bot
+func (m *Messages) UpdateMessage(messageText string, channelID string, timestamp string) {
+	if _, _, _, err := m.slackClient().UpdateMessage(channelID, timestamp, messageText); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"channel": channelID, "timestamp": timestamp}).Error("Could not update the message")
+	}
+}
+
+// SendDirectMessage sends a message to a user in a direct message channel
+func (m *Messages) SendDirectMessage(messageText string, userID string) {
+	_, _, channelID, err := m.slackClient().OpenIMChannel(userID)
 	if err != nil {
-		fmt.Printf("%s\n", err)
+		logrus.WithError(err).WithField("user", userID).Error("Could not open a direct message channel")
 		return
 	}
-	fmt.Printf("Message successfully sent to channel %s at %s\n", channelID, timestamp)
+	m.SendMessage(messageText, channelID)
+}
+
+// GetChannelTopic returns the topic of a public or private channel
+func (m *Messages) GetChannelTopic(channelID string) (string, error) {
+	if strings.HasPrefix(channelID, "G") {
+		group, err := m.slackClient().GetGroupInfo(channelID)
+		if err != nil {
+			return "", err
+		}
+		return group.Topic.Value, nil
+	}
+
+	channel, err := m.slackClient().GetChannelInfo(channelID)
+	if err != nil {
+		return "", err
+	}
+	return channel.Topic.Value, nil
+}
+
+// SetChannelTopic sets the topic of a public or private channel
+func (m *Messages) SetChannelTopic(channelID string, topic string) error {
+	var err error
+	if strings.HasPrefix(channelID, "G") {
+		_, err = m.slackClient().SetGroupTopic(channelID, topic)
+	} else {
+		_, err = m.slackClient().SetChannelTopic(channelID, topic)
+	}
+	return err
+}
+
+// Permalink returns the link to a message in slack
+func (m *Messages) Permalink(channelID string, timestamp string) string {
+	if m.teamDomain == "" {
+		teamInfo, err := m.slackClient().GetTeamInfo()
+		if err != nil {
+			logrus.WithError(err).Warn("Could not look up the slack team")
+			return ""
+		}
+		m.teamDomain = teamInfo.Domain
+	}
+	return fmt.Sprintf("https://%s.slack.com/archives/%s/p%s", m.teamDomain, channelID, strings.Replace(timestamp, ".", "", 1))
 }
 
 func (m *Messages) IsDirectMessage(msg *slack.MessageEvent) bool {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The prometheus metrics of the bot, served on /metrics by Health.
+// They are counted for the whole process, every appContext adds to the same metrics.
+var (
+	messagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "molliebot_messages_received_total",
+		Help: "Slack messages received from users.",
+	})
+	intentsMatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "molliebot_intents_matched_total",
+		Help: "Messages addressed to the bot, by the intent they matched.",
+	}, []string{"intent"})
+	repliesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "molliebot_replies_sent_total",
+		Help: "Messages and files sent to slack, by outcome.",
+	}, []string{"outcome"})
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "molliebot_api_requests_total",
+		Help: "HTTP requests to the slack, pagerduty and opsgenie APIs, by HTTP status code. Code error is a request that got no response.",
+	}, []string{"api", "code"})
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "molliebot_api_errors_total",
+		Help: "HTTP requests to the slack, pagerduty and opsgenie APIs that failed or got a 4xx or 5xx response.",
+	}, []string{"api"})
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "molliebot_api_request_duration_seconds",
+		Help:    "Duration of the HTTP requests to the slack, pagerduty and opsgenie APIs.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"api"})
+	jobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "molliebot_job_runs_total",
+		Help: "Runs of the scheduled jobs, by outcome.",
+	}, []string{"job", "outcome"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "molliebot_job_duration_seconds",
+		Help:    "Duration of the runs of the scheduled jobs.",
+		Buckets: []float64{.1, .5, 1, 5, 10, 30, 60, 300},
+	}, []string{"job"})
+	jobLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "molliebot_job_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful run of the scheduled jobs.",
+	}, []string{"job"})
+	slackConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "molliebot_slack_connected",
+		Help: "1 when the slack RTM connection is up.",
+	})
+)
+
+// registerMetrics registers the metrics with prometheus and times the API requests,
+// by wrapping the default HTTP transport the slack and pagerduty clients use. It changes the whole process, main calls it once.
+func registerMetrics() {
+	prometheus.MustRegister(messagesReceived, intentsMatched, repliesSent, apiRequests, apiErrors, apiDuration,
+		jobRuns, jobDuration, jobLastSuccess, slackConnected)
+	http.DefaultTransport = &instrumentedTransport{next: http.DefaultTransport}
+}
+
+// countIntent counts a request the bot understood
+func countIntent(intent string) {
+	intentsMatched.WithLabelValues(intent).Inc()
+}
+
+// countReply counts a message sent to slack
+func countReply(err error) {
+	if err != nil {
+		repliesSent.WithLabelValues("error").Inc()
+		return
+	}
+	repliesSent.WithLabelValues("success").Inc()
+}
+
+// countJobRun counts a run of a scheduled job
+func countJobRun(name string, start time.Time, duration time.Duration, err error) {
+	jobDuration.WithLabelValues(name).Observe(duration.Seconds())
+	if err != nil {
+		jobRuns.WithLabelValues(name, "error").Inc()
+		return
+	}
+	jobRuns.WithLabelValues(name, "success").Inc()
+	jobLastSuccess.WithLabelValues(name).Set(float64(start.Unix()))
+}
+
+// instrumentedTransport counts and times the requests to the APIs the bot uses
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (transport *instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	api := apiName(request.URL.Hostname())
+	start := time.Now()
+	response, err := transport.next.RoundTrip(request)
+	apiDuration.WithLabelValues(api).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		apiRequests.WithLabelValues(api, "error").Inc()
+		apiErrors.WithLabelValues(api).Inc()
+		return response, err
+	}
+
+	apiRequests.WithLabelValues(api, strconv.Itoa(response.StatusCode)).Inc()
+	if response.StatusCode >= 400 {
+		apiErrors.WithLabelValues(api).Inc()
+	}
+	return response, nil
+}
+
+// apiName returns the API a host belongs to, for the labels of the API metrics
+func apiName(host string) string {
+	switch {
+	case strings.HasSuffix(host, "slack.com"):
+		return "slack"
+	case strings.HasSuffix(host, "pagerduty.com"):
+		return "pagerduty"
+	case strings.HasSuffix(host, "opsgenie.com"):
+		return "opsgenie"
+	}
+	return "other"
+}
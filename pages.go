@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+	"github.com/wvdeutekom/molliebot/schedules"
+)
+
+// Pages lets people page a pagerduty service from slack.
+// Every page has to be confirmed by the person who asked for it, so nobody gets woken up by a typo.
+type Pages struct {
+	// Optional channel in which every page is logged
+	AuditChannel string `mapstructure:"audit_channel"`
+
+	pending    map[string]pendingPage
+	mutex      sync.Mutex
+	appContext *AppContext
+}
+
+type pendingPage struct {
+	pageTarget schedules.PageTarget
+	title      string
+	slackUser  string
+	channel    string
+	permalink  string
+	expires    time.Time
+}
+
+const pageConfirmationTimeout = 5 * time.Minute
+
+// confirmationCodes generates the codes of pages and swaps. It is seeded, so the codes differ after a restart.
+var confirmationCodes = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// newConfirmationCode returns a random 4 digit code for which pending returns false
+func newConfirmationCode(pending func(code string) bool) string {
+	confirmationCodes.Lock()
+	defer confirmationCodes.Unlock()
+
+	for {
+		code := fmt.Sprintf("%04d", confirmationCodes.Intn(10000))
+		if !pending(code) {
+			return code
+		}
+	}
+}
+
+func (pages *Pages) Setup(appContext *AppContext) {
+	pages.appContext = appContext
+	pages.pending = make(map[string]pendingPage)
+}
+
+// Request asks the sender of msg to confirm paging the target that matches targetQuery
+func (pages *Pages) Request(msg *slack.MessageEvent, targetQuery string, title string) {
+
+	pageTarget, ok := pages.appContext.Schedule.FindPageTarget(targetQuery)
+	if !ok {
+		var names []string
+		for _, pageTarget := range pages.appContext.Schedule.PageTargets {
+			names = append(names, pageTarget.Name)
+		}
+		pages.appContext.Message.SendMessage(fmt.Sprintf("I don't know how to page '%s'. I can page: %s", targetQuery, strings.Join(names, ", ")), msg.Channel)
+		return
+	}
+
+	if title == "" {
+		pages.appContext.Message.SendMessage(fmt.Sprintf("What's wrong? Tell me in the same message, like: mollie page %s checkout is down", pageTarget.Name), msg.Channel)
+		return
+	}
+
+	// Asking slack for the permalink can take a while, other pages shouldn't wait for it
+	permalink := pages.appContext.Message.Permalink(msg.Channel, msg.Timestamp)
+
+	pages.mutex.Lock()
+	pages.removeExpired()
+	code := newConfirmationCode(func(code string) bool {
+		_, pending := pages.pending[code]
+		return pending
+	})
+	pages.pending[code] = pendingPage{
+		pageTarget: pageTarget,
+		title:      title,
+		slackUser:  msg.User,
+		channel:    msg.Channel,
+		permalink:  permalink,
+		expires:    time.Now().Add(pageConfirmationTimeout),
+	}
+	pages.mutex.Unlock()
+
+	pages.appContext.Message.SendMessage(fmt.Sprintf("You are about to page *%s* with: %s\n"+
+		"Reply `mollie confirm page %s` within %v minutes to wake them up.", pageTarget.Name, title, code, pageConfirmationTimeout.Minutes()), msg.Channel)
+}
+
+// Confirm triggers the pending page with the given code, if it was requested by the sender of msg.
+// The page stays pending until it is confirmed by someone who may trigger it.
+func (pages *Pages) Confirm(msg *slack.MessageEvent, code string) {
+
+	pagerdutyUserID, knownUser := pages.appContext.Identity.PagerdutyUserID(msg.User)
+
+	pages.mutex.Lock()
+	pages.removeExpired()
+	page, ok := pages.pending[code]
+	if ok && page.slackUser == msg.User && knownUser {
+		delete(pages.pending, code)
+	}
+	pages.mutex.Unlock()
+
+	if !ok {
+		pages.appContext.Message.SendMessage(fmt.Sprintf("There is no page waiting for confirmation with code %s, maybe it expired?", code), msg.Channel)
+		return
+	}
+	if page.slackUser != msg.User {
+		pages.appContext.Message.SendMessage(fmt.Sprintf("Only <@%s> can confirm this page.", page.slackUser), msg.Channel)
+		return
+	}
+	if !knownUser {
+		pages.appContext.Message.SendMessage("I don't know who you are in pagerduty. Ask an admin to add you to the identity overrides in my config.", msg.Channel)
+		return
+	}
+
+	details := fmt.Sprintf("Paged from slack by %s: %s", pages.appContext.Message.RetrieveSlackUsername(msg.User), page.permalink)
+	incident, err := pages.appContext.Schedule.TriggerIncident(page.pageTarget, pagerdutyUserID, page.title, details)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"target": page.pageTarget.Name, "user": msg.User}).Error("Paging failed")
+		pages.appContext.Message.SendMessage(fmt.Sprintf("Paging *%s* failed: %v", page.pageTarget.Name, err), msg.Channel)
+		return
+	}
+
+	pages.audit(fmt.Sprintf("<@%s> paged *%s* (service %s): %s. Incident: %s, requested in %s",
+		msg.User, page.pageTarget.Name, page.pageTarget.Service, page.title, incident.HTMLURL, page.permalink))
+	pages.appContext.Message.SendMessage(fmt.Sprintf("Paged *%s*, incident #%d: %s", page.pageTarget.Name, incident.IncidentNumber, incident.HTMLURL), msg.Channel)
+}
+
+// audit records a page in the log and, when configured, in the audit channel
+func (pages *Pages) audit(entry string) {
+	logrus.WithField("audit", true).Info(entry)
+	if pages.AuditChannel != "" {
+		pages.appContext.Message.SendMessage(entry, pages.AuditChannel)
+	}
+}
+
+// removeExpired removes pages that were not confirmed in time, the mutex must be held
+func (pages *Pages) removeExpired() {
+	for code, page := range pages.pending {
+		if time.Now().After(page.expires) {
+			delete(pages.pending, code)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package schedules
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// apiEndpoint is used for the calls go-pagerduty does not support, unless the client has an APIURL
+const apiEndpoint = "https://api.pagerduty.com"
+
+func (client *Client) apiURL() string {
+	if client.APIURL != "" {
+		return client.APIURL
+	}
+	return apiEndpoint
+}
+
+// apiClient makes the API requests when the client has no HTTPClient, a request that hangs would block a job or a reply forever
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return apiClient
+}
+
+// apiRequest calls the pagerduty REST API directly. If from is not empty it is sent as the From header,
+// which pagerduty requires for changes made on behalf of a user. The response is decoded into result when it is not nil.
+func (client *Client) apiRequest(method string, path string, from string, payload interface{}, result interface{}) error {
+	return withBackoff(func() error {
+		return client.doAPIRequest(method, path, from, payload, result)
+	})
+}
+
+func (client *Client) doAPIRequest(method string, path string, from string, payload interface{}, result interface{}) error {
+
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(method, client.apiURL()+path, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	request.Header.Set("Authorization", "Token token="+client.pagerdutyAPIKey())
+	request.Header.Set("Content-Type", "application/json")
+	if from != "" {
+		request.Header.Set("From", from)
+	}
+
+	response, err := client.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return newAPIError("pagerduty", method, path, response)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
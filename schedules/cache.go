@@ -0,0 +1,101 @@
+package schedules
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// onCallCache holds the users that were on call at the last refresh.
+// It is refreshed in the background by the cron in main.go and by readers that find it older than its TTL,
+// those readers get the stale data in the meantime.
+type onCallCache struct {
+	mutex      sync.RWMutex
+	users      []OnCallUser
+	updated    time.Time
+	refreshErr error
+	refreshing bool
+}
+
+// onCallSnapshot is a consistent copy of the cache
+type onCallSnapshot struct {
+	users      []OnCallUser
+	updated    time.Time
+	refreshErr error
+}
+
+const defaultOnCallTTL = 10 * time.Minute
+
+func (cache *onCallCache) snapshot() onCallSnapshot {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return onCallSnapshot{cache.users, cache.updated, cache.refreshErr}
+}
+
+// store replaces the cached users. When err is set the users are kept and the error is remembered.
+func (cache *onCallCache) store(users []OnCallUser, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.storeLocked(users, err)
+}
+
+// finishRefresh stores the users of the refresh that startRefresh started
+func (cache *onCallCache) finishRefresh(users []OnCallUser, err error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.refreshing = false
+	cache.storeLocked(users, err)
+}
+
+func (cache *onCallCache) storeLocked(users []OnCallUser, err error) {
+	cache.refreshErr = err
+	if err == nil {
+		cache.users = users
+		cache.updated = time.Now()
+	}
+}
+
+// startRefresh marks the cache as being refreshed, it returns false when a refresh is already running
+func (cache *onCallCache) startRefresh() bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.refreshing {
+		return false
+	}
+	cache.refreshing = true
+	return true
+}
+
+func (client *Client) onCallTTL() time.Duration {
+	if client.OnCallTTLMinutes > 0 {
+		return time.Duration(client.OnCallTTLMinutes) * time.Minute
+	}
+	return defaultOnCallTTL
+}
+
+// cachedOnCallUsers returns the cached on-call users. They are only fetched right away if they were never fetched,
+// when they are older than the TTL they are refreshed in the background. Nobody being on call is cached as well.
+func (client *Client) cachedOnCallUsers() (onCallSnapshot, error) {
+
+	snapshot := client.onCall.snapshot()
+	if snapshot.updated.IsZero() {
+		if _, err := client.GetCurrentOnCallUsers(); err != nil {
+			return snapshot, err
+		}
+		return client.onCall.snapshot(), nil
+	}
+
+	if time.Since(snapshot.updated) > client.onCallTTL() && client.onCall.startRefresh() {
+		go func() {
+			users, err := client.onCallProvider().CurrentOnCall()
+			if err != nil {
+				logrus.WithError(err).Warn("Could not refresh the on-call users")
+			}
+			client.onCall.finishRefresh(users, err)
+		}()
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,37 @@
+package schedules
+
+import "testing"
+
+// countingProvider counts how often the users on call are fetched, nobody is on call
+type countingProvider struct {
+	OnCallProvider
+	fetches int
+}
+
+func (provider *countingProvider) Name() string {
+	return "Counting"
+}
+
+func (provider *countingProvider) CurrentOnCall() ([]OnCallUser, error) {
+	provider.fetches++
+	return nil, nil
+}
+
+func TestCachedOnCallUsersWithNobodyOnCall(t *testing.T) {
+
+	provider := &countingProvider{}
+	client := &Client{provider: provider}
+
+	for i := 0; i < 3; i++ {
+		snapshot, err := client.cachedOnCallUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot.users) != 0 || snapshot.updated.IsZero() {
+			t.Errorf("got snapshot %+v", snapshot)
+		}
+	}
+	if provider.fetches != 1 {
+		t.Errorf("the users on call were fetched %d times, expected the empty result to be cached", provider.fetches)
+	}
+}
@@ -0,0 +1,225 @@
+package schedules
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/wvdeutekom/molliebot/dates"
+)
+
+// userLoad is the on-call load of a single user in the fairness report
+type userLoad struct {
+	name         string
+	hours        float64
+	weekendHours float64
+	holidayHours float64
+	incidents    int
+}
+
+// CompileFairnessReport returns a report of how the on-call load was spread over the users in the last months,
+// as a slack message and as CSV
+func (client *Client) CompileFairnessReport(months int) (string, string, error) {
+
+	location, _ := time.LoadLocation("Europe/Amsterdam")
+	untilTime := dates.StartOfDay(time.Now().In(location))
+	fromTime := untilTime.AddDate(0, -months, 0)
+
+	// Fetch a month at a time, a page of on-calls is easily exceeded when fetching several months at once
+	var shifts []Shift
+	for monthStart := fromTime; monthStart.Before(untilTime); monthStart = monthStart.AddDate(0, 1, 0) {
+		monthEnd := monthStart.AddDate(0, 1, 0)
+		if monthEnd.After(untilTime) {
+			monthEnd = untilTime
+		}
+		monthShifts, err := client.onCallProvider().Shifts(monthStart, monthEnd)
+		if err != nil {
+			return "", "", err
+		}
+		shifts = append(shifts, monthShifts...)
+	}
+
+	loads := make(map[string]*userLoad)
+	// A shift shows up for every month it spans, only count it once
+	counted := make(map[string]bool)
+
+	for _, shift := range shifts {
+		key := shift.Schedule.ID + shift.User.ID + shift.Start.String()
+		if counted[key] {
+			continue
+		}
+		counted[key] = true
+
+		load, ok := loads[shift.User.ID]
+		if !ok {
+			load = &userLoad{name: shift.User.Summary}
+			loads[shift.User.ID] = load
+		}
+
+		// Only count the part of the shift within the report period
+		shiftStart := shift.Start.In(location)
+		shiftEnd := shift.End.In(location)
+		if shiftStart.Before(fromTime) {
+			shiftStart = fromTime
+		}
+		if shiftEnd.After(untilTime) {
+			shiftEnd = untilTime
+		}
+		client.addShiftHours(load, shiftStart, shiftEnd)
+	}
+
+	// Incidents are only known when the schedules are in pagerduty as well
+	if provider, ok := client.onCallProvider().(*pagerdutyProvider); ok {
+		if err := client.countIncidents(provider, loads, fromTime, untilTime); err != nil {
+			return "", "", err
+		}
+	}
+
+	var sortedLoads []*userLoad
+	var totalHours float64
+	for _, load := range loads {
+		sortedLoads = append(sortedLoads, load)
+		totalHours += load.hours
+	}
+	sort.Slice(sortedLoads, func(i, j int) bool { return sortedLoads[i].hours > sortedLoads[j].hours })
+
+	if len(sortedLoads) == 0 {
+		return fmt.Sprintf("Nobody has been on call since %s.", fromTime.Format("2006-01-02")), "", nil
+	}
+	averageHours := totalHours / float64(len(sortedLoads))
+
+	formattedReport := fmt.Sprintf("On-call load from %s to %s:\n\n", fromTime.Format("2006-01-02"), untilTime.Format("2006-01-02"))
+
+	var csvBuffer bytes.Buffer
+	csvWriter := csv.NewWriter(&csvBuffer)
+	csvWriter.Write([]string{"user", "hours", "weekend_hours", "holiday_hours", "weekend_holiday_share", "incidents", "load_vs_average"})
+
+	for _, load := range sortedLoads {
+		offHoursShare := 0.0
+		if load.hours > 0 {
+			offHoursShare = (load.weekendHours + load.holidayHours) / load.hours
+		}
+		relativeLoad := load.hours / averageHours
+
+		formattedReport = formattedReport + fmt.Sprintf("%s: %0.0f hours (%0.0f%% weekends/holidays), %d incidents, %0.2fx the average load\n",
+			load.name, load.hours, offHoursShare*100, load.incidents, relativeLoad)
+
+		csvWriter.Write([]string{
+			load.name,
+			strconv.FormatFloat(load.hours, 'f', 2, 64),
+			strconv.FormatFloat(load.weekendHours, 'f', 2, 64),
+			strconv.FormatFloat(load.holidayHours, 'f', 2, 64),
+			strconv.FormatFloat(offHoursShare, 'f', 4, 64),
+			strconv.Itoa(load.incidents),
+			strconv.FormatFloat(relativeLoad, 'f', 4, 64),
+		})
+	}
+	csvWriter.Flush()
+
+	formattedReport = formattedReport + fmt.Sprintf("\nFairness score: %0.0f/100. 100 means everyone was on call for the same number of hours.", fairnessScore(sortedLoads, averageHours))
+
+	return formattedReport, csvBuffer.String(), nil
+}
+
+// countIncidents adds the incidents created during their shifts to loads.
+// Incidents are attributed to whoever was first in line of the escalation policy when the incident was created.
+func (client *Client) countIncidents(provider *pagerdutyProvider, loads map[string]*userLoad, fromTime time.Time, untilTime time.Time) error {
+
+	var onCalls []onCallEntry
+	for monthStart := fromTime; monthStart.Before(untilTime); monthStart = monthStart.AddDate(0, 1, 0) {
+		monthEnd := monthStart.AddDate(0, 1, 0)
+		if monthEnd.After(untilTime) {
+			monthEnd = untilTime
+		}
+		monthOnCalls, err := provider.listOncalls(monthStart, monthEnd, nil, nil)
+		if err != nil {
+			return err
+		}
+		onCalls = append(onCalls, monthOnCalls...)
+	}
+
+	query := url.Values{}
+	query.Set("since", fromTime.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"))
+	query.Set("until", untilTime.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"))
+	incidents, err := client.listIncidents(query)
+	if err != nil {
+		return err
+	}
+
+	// The same shift shows up for every month it spans, only count it once
+	counted := make(map[string]bool)
+
+	for _, onCall := range onCalls {
+		load, ok := loads[onCall.User.ID]
+		escalationKey := onCall.EscalationPolicy.ID + onCall.User.ID + onCall.Start
+		if !ok || onCall.Schedule.ID == "" || onCall.EscalationLevel != 1 || counted[escalationKey] {
+			continue
+		}
+		counted[escalationKey] = true
+
+		shiftStart := dates.StringToDate(onCall.Start, dates.StringToDateOptions{Format: "2006-01-02T15:04:05Z07:00"})
+		shiftEnd := dates.StringToDate(onCall.End, dates.StringToDateOptions{Format: "2006-01-02T15:04:05Z07:00"})
+		for _, incident := range incidents {
+			createdAt := dates.StringToDate(incident.CreatedAt, dates.StringToDateOptions{Format: "2006-01-02T15:04:05Z07:00"})
+			if incident.EscalationPolicy.ID == onCall.EscalationPolicy.ID && !createdAt.Before(shiftStart) && createdAt.Before(shiftEnd) {
+				load.incidents++
+			}
+		}
+	}
+	return nil
+}
+
+// addShiftHours adds the hours between start and end to load, split into weekend and holiday hours per day
+func (client *Client) addShiftHours(load *userLoad, start time.Time, end time.Time) {
+
+	for dayStart := dates.StartOfDay(start); dayStart.Before(end); dayStart = dayStart.AddDate(0, 0, 1) {
+		segmentStart, segmentEnd := dayStart, dayStart.AddDate(0, 0, 1)
+		if segmentStart.Before(start) {
+			segmentStart = start
+		}
+		if segmentEnd.After(end) {
+			segmentEnd = end
+		}
+
+		hours := segmentEnd.Sub(segmentStart).Hours()
+		load.hours += hours
+
+		// A holiday on a weekend day counts as a holiday
+		switch {
+		case client.isHoliday(dayStart):
+			load.holidayHours += hours
+		case dayStart.Weekday() == time.Saturday || dayStart.Weekday() == time.Sunday:
+			load.weekendHours += hours
+		}
+	}
+}
+
+func (client *Client) isHoliday(day time.Time) bool {
+	for _, holiday := range client.Holidays {
+		if holiday == day.Format("2006-01-02") {
+			return true
+		}
+	}
+	return false
+}
+
+// fairnessScore is 100 minus the coefficient of variation of the on-call hours as a percentage, with a minimum of 0
+func fairnessScore(loads []*userLoad, averageHours float64) float64 {
+
+	if averageHours == 0 {
+		return 100
+	}
+
+	var variance float64
+	for _, load := range loads {
+		variance += math.Pow(load.hours-averageHours, 2)
+	}
+	variance = variance / float64(len(loads))
+
+	return math.Max(0, 100*(1-math.Sqrt(variance)/averageHours))
+}
@@ -0,0 +1,188 @@
+package schedules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wvdeutekom/go-pagerduty"
+)
+
+const (
+	// Number of requests that are made at the same time when fetching users
+	maxConcurrentRequests = 4
+	// Users and their contact methods rarely change, so they are cached much longer than who is on call
+	userTTL = time.Hour
+	// Number of attempts for a request the API answers with 429 Too Many Requests
+	maxAttempts = 5
+)
+
+// userCache holds users with their contact methods
+type userCache struct {
+	mutex sync.Mutex
+	users map[string]cachedUser
+}
+
+type cachedUser struct {
+	user    pagerduty.User
+	fetched time.Time
+}
+
+func (cache *userCache) get(userID string) (pagerduty.User, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cached, ok := cache.users[userID]
+	if !ok || time.Since(cached.fetched) > userTTL {
+		return pagerduty.User{}, false
+	}
+	return cached.user, true
+}
+
+func (cache *userCache) put(user pagerduty.User) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.users == nil {
+		cache.users = make(map[string]cachedUser)
+	}
+	cache.users[user.ID] = cachedUser{user, time.Now()}
+}
+
+// getUsers returns the users with the given IDs and their contact methods, from the cache when possible.
+// The missing users are fetched with fetch, with a bounded number of concurrent requests.
+func getUsers(cache *userCache, userIDs []string, fetch func(userID string) (pagerduty.User, error)) (map[string]pagerduty.User, error) {
+
+	users := make(map[string]pagerduty.User)
+	var missingUserIDs []string
+	for _, userID := range userIDs {
+		if _, ok := users[userID]; ok {
+			continue
+		}
+		if user, ok := cache.get(userID); ok {
+			users[userID] = user
+		} else {
+			// Mark the user as seen, it is replaced by the fetched user below
+			users[userID] = pagerduty.User{}
+			missingUserIDs = append(missingUserIDs, userID)
+		}
+	}
+
+	var mutex sync.Mutex
+	var firstErr error
+
+	var wait sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrentRequests)
+
+	for _, userID := range missingUserIDs {
+		wait.Add(1)
+		go func(userID string) {
+			defer wait.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			user, err := fetch(userID)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			cache.put(user)
+			users[userID] = user
+		}(userID)
+	}
+	wait.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return users, nil
+}
+
+// apiError is a response of the pagerduty or opsgenie REST API with an unexpected HTTP status
+type apiError struct {
+	api        string
+	method     string
+	path       string
+	status     int
+	body       string
+	retryAfter time.Duration
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("%s %s %s failed with HTTP status %d: %s", err.api, err.method, err.path, err.status, err.body)
+}
+
+// newAPIError reads the error from a response that is not 2xx
+func newAPIError(api string, method string, path string, response *http.Response) *apiError {
+	body, _ := ioutil.ReadAll(response.Body)
+	return &apiError{
+		api:        api,
+		method:     method,
+		path:       path,
+		status:     response.StatusCode,
+		body:       string(body),
+		retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter returns the wait of a Retry-After header, in seconds or as a date. It returns 0 when there is none.
+func parseRetryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(time.Now()) {
+		return date.Sub(time.Now())
+	}
+	return 0
+}
+
+// sleep waits between attempts, replaced in tests
+var sleep = time.Sleep
+
+// withBackoff calls request again when the API answers with 429 Too Many Requests. It waits as long
+// as the Retry-After header says, or twice as long before every attempt when there is none.
+func withBackoff(request func() error) error {
+
+	wait := time.Second
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = request(); err == nil || !isRateLimited(err) {
+			return err
+		}
+		if attempt < maxAttempts {
+			if apiErr, ok := err.(*apiError); ok && apiErr.retryAfter > 0 {
+				sleep(apiErr.retryAfter)
+			} else {
+				sleep(wait)
+			}
+			wait = wait * 2
+		}
+	}
+	return err
+}
+
+// isRateLimited reports whether err is a 429 Too Many Requests response.
+// go-pagerduty only returns the status code as part of the error message.
+func isRateLimited(err error) bool {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.status == http.StatusTooManyRequests
+	}
+	return strings.Contains(err.Error(), "response code: 429")
+}
+
+// IsNotFound reports whether err is a 404 Not Found response, e.g. for an incident that doesn't exist
+func IsNotFound(err error) bool {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr.status == http.StatusNotFound
+	}
+	return err != nil && strings.Contains(err.Error(), "response code: 404")
+}
@@ -0,0 +1,174 @@
+package schedules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithBackoff(t *testing.T) {
+
+	var waits []time.Duration
+	sleep = func(wait time.Duration) { waits = append(waits, wait) }
+	defer func() { sleep = time.Sleep }()
+
+	tests := []struct {
+		name       string
+		retryAfter string
+		// The number of 429 responses before the request succeeds
+		limited int
+		waits   []time.Duration
+		err     bool
+	}{
+		{"retry after", "7", 2, []time.Duration{7 * time.Second, 7 * time.Second}, false},
+		{"doubling", "", 3, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, false},
+		{"invalid retry after", "soon", 1, []time.Duration{time.Second}, false},
+		{"gives up", "", maxAttempts, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, true},
+	}
+
+	for _, test := range tests {
+		waits = nil
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= test.limited {
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{}`))
+		}))
+		defer server.Close()
+
+		client := &Client{APIKey: "test-key", APIURL: server.URL, HTTPClient: server.Client()}
+		err := client.apiRequest("GET", "/users/PUSER1", "", nil, nil)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if fmt.Sprint(waits) != fmt.Sprint(test.waits) {
+			t.Errorf("%s: waited %v, expected %v", test.name, waits, test.waits)
+		}
+	}
+}
+
+func TestWithBackoffOtherErrors(t *testing.T) {
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := &Client{APIKey: "test-key", APIURL: server.URL, HTTPClient: server.Client()}
+	err := client.apiRequest("GET", "/users/PUSER1", "", nil, nil)
+	if apiErr, ok := err.(*apiError); !ok || apiErr.status != http.StatusInternalServerError {
+		t.Errorf("got error %v, expected a 500 response", err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, only 429 responses are retried", requests)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	if wait := parseRetryAfter("30"); wait != 30*time.Second {
+		t.Errorf("got %v for 30 seconds", wait)
+	}
+	if wait := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); wait <= 58*time.Second || wait > time.Minute {
+		t.Errorf("got %v for a date a minute from now", wait)
+	}
+	for _, header := range []string{"", "0", "-5", "soon", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)} {
+		if wait := parseRetryAfter(header); wait != 0 {
+			t.Errorf("got %v for %q", wait, header)
+		}
+	}
+}
+
+func TestListOncallsIncludesUsers(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oncalls" || r.URL.Query().Get("include[]") != "users" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"oncalls": []map[string]interface{}{{
+				"user":     map[string]string{"id": "PUSER1", "type": "user", "summary": "User One", "email": "user1@example.com", "time_zone": "Europe/Amsterdam"},
+				"schedule": map[string]string{"id": "PSCHED1", "summary": "Primary"},
+				"start":    "2017-12-24T10:00:00Z",
+				"end":      "2017-12-31T10:00:00Z",
+			}},
+		})
+	}))
+	defer server.Close()
+
+	provider := newPagerdutyProvider(nil, &Client{APIKey: "test-key", APIURL: server.URL, HTTPClient: server.Client()})
+	onCalls, err := provider.listOncalls(time.Now(), time.Now().Add(time.Hour), []string{"PSCHED1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onCalls) != 1 {
+		t.Fatalf("got %d on-calls", len(onCalls))
+	}
+	user := onCalls[0].User
+	if user.ID != "PUSER1" || user.Summary != "User One" || user.Email != "user1@example.com" || user.Timezone != "Europe/Amsterdam" {
+		t.Errorf("the user was not decoded: %+v", user)
+	}
+	if onCalls[0].Schedule.ID != "PSCHED1" {
+		t.Errorf("the schedule was not decoded: %+v", onCalls[0].Schedule)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"no error", nil, false},
+		{"404 of the REST API", &apiError{status: http.StatusNotFound}, true},
+		{"other status of the REST API", &apiError{status: http.StatusUnauthorized}, false},
+		{"404 of go-pagerduty", errors.New("Failed call API endpoint. HTTP response code: 404. Error: Not Found"), true},
+		{"timeout", errors.New("net/http: request canceled"), false},
+	}
+
+	for _, test := range tests {
+		if notFound := IsNotFound(test.err); notFound != test.expected {
+			t.Errorf("%s: got %t, expected %t", test.name, notFound, test.expected)
+		}
+	}
+}
+
+func TestGetScheduleListReadsAllPages(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schedules" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		// 3 pages of 2 schedules
+		offset := 0
+		fmt.Sscan(r.URL.Query().Get("offset"), &offset)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schedules": []map[string]string{{"id": fmt.Sprintf("PSCHED%d", offset+1)}, {"id": fmt.Sprintf("PSCHED%d", offset+2)}},
+			"offset":    offset,
+			"more":      offset < 4,
+		})
+	}))
+	defer server.Close()
+
+	provider := newPagerdutyProvider(nil, &Client{APIKey: "test-key", APIURL: server.URL, HTTPClient: server.Client()})
+	schedules, err := provider.getScheduleList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 6 || schedules[5].ID != "PSCHED6" {
+		t.Errorf("got schedules %+v, expected all 3 pages", schedules)
+	}
+}
@@ -0,0 +1,249 @@
+package schedules
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wvdeutekom/go-pagerduty"
+	"github.com/wvdeutekom/molliebot/dates"
+	"github.com/wvdeutekom/molliebot/helpers"
+)
+
+// ErrNotAssigned is returned when someone tries to change an incident that is not assigned to them
+var ErrNotAssigned = errors.New("incident is not assigned to this user")
+
+// GetOpenIncidentsMessage returns a message listing all triggered and acknowledged incidents
+func (client *Client) GetOpenIncidentsMessage() (string, error) {
+
+	query := url.Values{}
+	query.Add("statuses[]", "triggered")
+	query.Add("statuses[]", "acknowledged")
+	query.Set("sort_by", "created_at:desc")
+
+	incidents, err := client.listIncidents(query)
+	if err != nil {
+		return "", err
+	}
+
+	if len(incidents) == 0 {
+		return "There are no open incidents. Enjoy the silence!", nil
+	}
+
+	incidentsMessage := "Open incidents:\n"
+	for _, incident := range incidents {
+		incidentsMessage = incidentsMessage + client.formatIncidentLine(incident) + "\n"
+	}
+	return incidentsMessage, nil
+}
+
+// incidentsPage is a page of the incidents list
+type incidentsPage struct {
+	Incidents []pagerduty.Incident `json:"incidents"`
+	Offset    int                  `json:"offset"`
+	More      bool                 `json:"more"`
+}
+
+// listIncidents returns the incidents matching the filters in query, of all pages
+func (client *Client) listIncidents(query url.Values) ([]pagerduty.Incident, error) {
+
+	query.Set("limit", "100")
+
+	var incidents []pagerduty.Incident
+	for offset := 0; ; {
+		query.Set("offset", strconv.Itoa(offset))
+
+		var page incidentsPage
+		if err := client.apiRequest("GET", "/incidents?"+query.Encode(), "", nil, &page); err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, page.Incidents...)
+
+		if !page.More || len(page.Incidents) == 0 {
+			break
+		}
+		offset = page.Offset + len(page.Incidents)
+	}
+	return incidents, nil
+}
+
+// getIncident returns the incident with the given ID or number
+func (client *Client) getIncident(incidentNumber string) (*pagerduty.Incident, error) {
+	var response struct {
+		Incident pagerduty.Incident `json:"incident"`
+	}
+	if err := client.apiRequest("GET", "/incidents/"+url.PathEscape(incidentNumber), "", nil, &response); err != nil {
+		return nil, err
+	}
+	return &response.Incident, nil
+}
+
+// getUser returns the pagerduty user with the given ID
+func (client *Client) getUser(userID string) (*pagerduty.User, error) {
+	var response struct {
+		User pagerduty.User `json:"user"`
+	}
+	if err := client.apiRequest("GET", "/users/"+url.PathEscape(userID), "", nil, &response); err != nil {
+		return nil, err
+	}
+	return &response.User, nil
+}
+
+// GetIncidentMessage returns a message with the details of the incident with the given number
+func (client *Client) GetIncidentMessage(incidentNumber string) (string, error) {
+
+	incident, err := client.getIncident(incidentNumber)
+	if err != nil {
+		return "", err
+	}
+
+	incidentMessage := client.formatIncidentLine(*incident) + "\n"
+	incidentMessage = incidentMessage + fmt.Sprintf("Service: %s\n", incident.Service.Summary)
+	incidentMessage = incidentMessage + fmt.Sprintf("Urgency: %s\n", incident.Urgency)
+	incidentMessage = incidentMessage + fmt.Sprintf("Created: %s\n", formatIncidentTime(incident.CreatedAt))
+	if len(incident.Assignments) > 0 {
+		incidentMessage = incidentMessage + fmt.Sprintf("Assigned to: %s\n", client.assigneeNames(*incident))
+	}
+	for _, acknowledgement := range incident.Acknowledgements {
+		incidentMessage = incidentMessage + fmt.Sprintf("Acknowledged by %s at %s\n", acknowledgement.Acknowledger.Summary, formatIncidentTime(acknowledgement.At))
+	}
+	incidentMessage = incidentMessage + incident.HTMLURL
+
+	return incidentMessage, nil
+}
+
+// ManageIncident changes the status of the incident with the given number to 'acknowledged' or 'resolved'
+// on behalf of a pagerduty user. Only users the incident is assigned to may do this, otherwise ErrNotAssigned is returned.
+func (client *Client) ManageIncident(incidentNumber string, userID string, status string) (*pagerduty.Incident, error) {
+
+	if status != "acknowledged" && status != "resolved" {
+		return nil, fmt.Errorf("unknown incident status %q", status)
+	}
+
+	incident, err := client.getIncident(incidentNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := false
+	for _, assignment := range incident.Assignments {
+		if assignment.Assignee.ID == userID {
+			assigned = true
+		}
+	}
+	if !assigned {
+		return incident, ErrNotAssigned
+	}
+
+	// Pagerduty requires the email address of the user making the change
+	user, err := client.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// go-pagerduty decodes the ID of an incident into Id, the ID of its APIObject stays empty
+	update := incidentStatus{ID: incident.Id, Type: "incident_reference", Status: status}
+	payload := map[string][]incidentStatus{"incidents": {update}}
+	if err := client.apiRequest("PUT", "/incidents", user.Email, payload, nil); err != nil {
+		return nil, err
+	}
+
+	incident.Status = status
+	return incident, nil
+}
+
+func (client *Client) formatIncidentLine(incident pagerduty.Incident) string {
+	// The summary of an incident starts with its number, e.g. "[#1234] Payments API is down"
+	incidentLine := fmt.Sprintf("%s (%s)", incident.APIObject.Summary, incident.Status)
+	if len(incident.Assignments) > 0 {
+		incidentLine = incidentLine + " - " + client.assigneeNames(incident)
+	}
+	return incidentLine
+}
+
+func (client *Client) assigneeNames(incident pagerduty.Incident) string {
+	var names []string
+	for _, assignment := range incident.Assignments {
+		names = append(names, client.formatUserName(pagerduty.User{APIObject: assignment.Assignee, Name: assignment.Assignee.Summary}))
+	}
+	return strings.Join(names, ", ")
+}
+
+func formatIncidentTime(timestamp string) string {
+	location, _ := time.LoadLocation("Europe/Amsterdam")
+	return dates.StringToDate(timestamp, dates.StringToDateOptions{Format: "2006-01-02T15:04:05Z07:00"}).In(location).Format("2006-01-02 15:04")
+}
+
+// PageTarget is a pagerduty service that can be paged from slack
+type PageTarget struct {
+	Name    string `mapstructure:"name"`
+	Service string `mapstructure:"service"`
+	// Optional, the escalation policy of the service is used when empty
+	EscalationPolicy string `mapstructure:"escalation_policy"`
+}
+
+// FindPageTarget returns the page target whose name matches query
+func (client *Client) FindPageTarget(query string) (PageTarget, bool) {
+	for _, pageTarget := range client.PageTargets {
+		if helpers.FuzzyMatch(query, pageTarget.Name) {
+			return pageTarget, true
+		}
+	}
+	return PageTarget{}, false
+}
+
+type apiReference struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type incidentStatus struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+type incidentBody struct {
+	Type    string `json:"type"`
+	Details string `json:"details"`
+}
+
+type createIncident struct {
+	Type             string        `json:"type"`
+	Title            string        `json:"title"`
+	Service          apiReference  `json:"service"`
+	EscalationPolicy *apiReference `json:"escalation_policy,omitempty"`
+	Body             incidentBody  `json:"body"`
+}
+
+// TriggerIncident creates an incident for pageTarget on behalf of a pagerduty user
+func (client *Client) TriggerIncident(pageTarget PageTarget, userID string, title string, details string) (*pagerduty.Incident, error) {
+
+	// Pagerduty requires the email address of the user creating the incident
+	user, err := client.getUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	incident := createIncident{
+		Type:    "incident",
+		Title:   title,
+		Service: apiReference{pageTarget.Service, "service_reference"},
+		Body:    incidentBody{"incident_body", details},
+	}
+	if pageTarget.EscalationPolicy != "" {
+		incident.EscalationPolicy = &apiReference{pageTarget.EscalationPolicy, "escalation_policy_reference"}
+	}
+
+	var response struct {
+		Incident pagerduty.Incident `json:"incident"`
+	}
+	payload := map[string]createIncident{"incident": incident}
+	if err := client.apiRequest("POST", "/incidents", user.Email, payload, &response); err != nil {
+		return nil, err
+	}
+	return &response.Incident, nil
+}
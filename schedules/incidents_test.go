@@ -0,0 +1,191 @@
+package schedules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pagerdutyStandIn answers the pagerduty API requests of the incident tests
+type pagerdutyStandIn struct {
+	incidents []map[string]interface{}
+	users     map[string]string
+	// The PUT /incidents requests, with their From header
+	updates []string
+	t       *testing.T
+}
+
+// newTestClient returns a client that uses standIn as pagerduty, the server must be closed after the test
+func newTestClient(t *testing.T, standIn *pagerdutyStandIn) (*Client, *httptest.Server) {
+	standIn.t = t
+	server := httptest.NewServer(standIn)
+	return &Client{APIKey: "test-key", APIURL: server.URL, HTTPClient: server.Client()}, server
+}
+
+func testIncident(id string, number int, status string, assignee string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          id,
+		"type":        "incident",
+		"summary":     fmt.Sprintf("[#%d] Payments API is down", number),
+		"html_url":    "https://example.pagerduty.com/incidents/" + id,
+		"status":      status,
+		"urgency":     "high",
+		"created_at":  "2017-12-24T10:00:00Z",
+		"service":     map[string]string{"id": "PSERVIC", "summary": "Payments"},
+		"assignments": []map[string]interface{}{{"assignee": map[string]string{"id": assignee, "summary": "Assignee " + assignee}}},
+	}
+}
+
+func (standIn *pagerdutyStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Header.Get("Authorization") != "Token token=test-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/incidents":
+		// Pages of 2 incidents, to test that all pages are read
+		offset := 0
+		fmt.Sscan(r.URL.Query().Get("offset"), &offset)
+		end := offset + 2
+		if end > len(standIn.incidents) {
+			end = len(standIn.incidents)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"incidents": standIn.incidents[offset:end],
+			"offset":    offset,
+			"more":      end < len(standIn.incidents),
+		})
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/incidents/"):
+		id := strings.TrimPrefix(r.URL.Path, "/incidents/")
+		for _, incident := range standIn.incidents {
+			if incident["id"] == id {
+				json.NewEncoder(w).Encode(map[string]interface{}{"incident": incident})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/users/"):
+		id := strings.TrimPrefix(r.URL.Path, "/users/")
+		email, ok := standIn.users[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": map[string]string{"id": id, "email": email}})
+
+	case r.Method == "PUT" && r.URL.Path == "/incidents":
+		body, _ := ioutil.ReadAll(r.Body)
+		standIn.updates = append(standIn.updates, r.Header.Get("From")+" "+strings.TrimSpace(string(body)))
+		w.Write([]byte(`{"incidents": []}`))
+
+	default:
+		standIn.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestGetOpenIncidentsMessage(t *testing.T) {
+
+	standIn := &pagerdutyStandIn{}
+	for i := 1; i <= 5; i++ {
+		standIn.incidents = append(standIn.incidents, testIncident(fmt.Sprintf("PINC%d", i), i, "triggered", "PUSER1"))
+	}
+	client, server := newTestClient(t, standIn)
+	defer server.Close()
+
+	message, err := client.GetOpenIncidentsMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if !strings.Contains(message, fmt.Sprintf("[#%d] Payments API is down (triggered)", i)) {
+			t.Errorf("incident %d is missing from %q", i, message)
+		}
+	}
+
+	standIn.incidents = nil
+	message, err = client.GetOpenIncidentsMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "There are no open incidents. Enjoy the silence!" {
+		t.Errorf("got %q without incidents", message)
+	}
+}
+
+func TestGetIncidentMessage(t *testing.T) {
+
+	standIn := &pagerdutyStandIn{incidents: []map[string]interface{}{testIncident("PINC1", 1, "acknowledged", "PUSER1")}}
+	client, server := newTestClient(t, standIn)
+	defer server.Close()
+
+	message, err := client.GetIncidentMessage("PINC1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"[#1] Payments API is down (acknowledged)", "Service: Payments", "Urgency: high", "Assigned to: Assignee PUSER1", "https://example.pagerduty.com/incidents/PINC1"} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("%q is missing from %q", expected, message)
+		}
+	}
+
+	if _, err := client.GetIncidentMessage("PNOPE"); !IsNotFound(err) {
+		t.Errorf("got error %v for an unknown incident, expected it to be not found", err)
+	}
+}
+
+func TestManageIncident(t *testing.T) {
+
+	tests := []struct {
+		status string
+		userID string
+		err    error
+		update string
+	}{
+		{"acknowledged", "PUSER1", nil, `user1@example.com {"incidents":[{"id":"PINC1","type":"incident_reference","status":"acknowledged"}]}`},
+		{"resolved", "PUSER1", nil, `user1@example.com {"incidents":[{"id":"PINC1","type":"incident_reference","status":"resolved"}]}`},
+		{"resolved", "PUSER2", ErrNotAssigned, ""},
+	}
+
+	for _, test := range tests {
+		standIn := &pagerdutyStandIn{
+			incidents: []map[string]interface{}{testIncident("PINC1", 1, "triggered", "PUSER1")},
+			users:     map[string]string{"PUSER1": "user1@example.com", "PUSER2": "user2@example.com"},
+		}
+		client, server := newTestClient(t, standIn)
+		defer server.Close()
+
+		incident, err := client.ManageIncident("PINC1", test.userID, test.status)
+		if err != test.err {
+			t.Errorf("%s by %s: got error %v, expected %v", test.status, test.userID, err, test.err)
+			continue
+		}
+
+		if test.update == "" {
+			if len(standIn.updates) > 0 {
+				t.Errorf("%s by %s: the incident was changed: %v", test.status, test.userID, standIn.updates)
+			}
+			continue
+		}
+		if len(standIn.updates) != 1 || standIn.updates[0] != test.update {
+			t.Errorf("%s by %s: got updates %v, expected %s", test.status, test.userID, standIn.updates, test.update)
+		}
+		if incident.Status != test.status {
+			t.Errorf("%s by %s: the incident has status %s", test.status, test.userID, incident.Status)
+		}
+	}
+
+	client, server := newTestClient(t, &pagerdutyStandIn{})
+	defer server.Close()
+	if _, err := client.ManageIncident("PINC1", "PUSER1", "snoozed"); err == nil {
+		t.Error("expected an error for an unknown status")
+	}
+}
@@ -0,0 +1,324 @@
+package schedules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/wvdeutekom/go-pagerduty"
+)
+
+const defaultOpsgenieURL = "https://api.opsgenie.com"
+
+// opsgenieProvider reads the on-call schedules from opsgenie.
+// Opsgenie users are described as pagerduty users, their username is used as email address.
+type opsgenieProvider struct {
+	apiKey     string
+	apiURL     string
+	httpClient *http.Client
+	users      userCache
+}
+
+type opsgenieSchedule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type opsgenieParticipant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type opsgenieUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	FullName string `json:"fullName"`
+}
+
+type opsgenieContact struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	To     string `json:"to"`
+}
+
+type opsgeniePeriod struct {
+	StartDate string              `json:"startDate"`
+	EndDate   string              `json:"endDate"`
+	Type      string              `json:"type"`
+	Recipient opsgenieParticipant `json:"recipient"`
+}
+
+type opsgenieTimeline struct {
+	FinalTimeline struct {
+		Rotations []struct {
+			Periods []opsgeniePeriod `json:"periods"`
+		} `json:"rotations"`
+	} `json:"finalTimeline"`
+}
+
+func newOpsgenieProvider(apiKey string, apiURL string, httpClient *http.Client) *opsgenieProvider {
+	if apiURL == "" {
+		apiURL = defaultOpsgenieURL
+	}
+	return &opsgenieProvider{apiKey: apiKey, apiURL: apiURL, httpClient: httpClient}
+}
+
+func (provider *opsgenieProvider) Name() string {
+	return "Opsgenie"
+}
+
+// CurrentOnCall returns who is on call right now in every enabled schedule
+func (provider *opsgenieProvider) CurrentOnCall() ([]OnCallUser, error) {
+
+	schedules, err := provider.listSchedules()
+	if err != nil {
+		return nil, err
+	}
+
+	type scheduleUser struct {
+		schedule opsgenieSchedule
+		userID   string
+	}
+
+	var scheduleUsers []scheduleUser
+	var userIDs []string
+	for _, schedule := range schedules {
+		var onCalls struct {
+			Data struct {
+				OnCallParticipants []opsgenieParticipant `json:"onCallParticipants"`
+			} `json:"data"`
+		}
+		if err := provider.apiRequest("/v2/schedules/"+url.PathEscape(schedule.ID)+"/on-calls", nil, &onCalls); err != nil {
+			return nil, err
+		}
+
+		for _, participant := range onCalls.Data.OnCallParticipants {
+			// Teams and escalations can be on call as well, only users have a phone
+			if participant.Type != "user" {
+				continue
+			}
+			scheduleUsers = append(scheduleUsers, scheduleUser{schedule, participant.ID})
+			userIDs = append(userIDs, participant.ID)
+		}
+	}
+
+	users, err := getUsers(&provider.users, userIDs, provider.getUser)
+	if err != nil {
+		return nil, err
+	}
+
+	var onCallUsers []OnCallUser
+	for _, scheduleUser := range scheduleUsers {
+		onCallUsers = append(onCallUsers, OnCallUser{users[scheduleUser.userID], opsgenieToSchedule(scheduleUser.schedule)})
+	}
+	return onCallUsers, nil
+}
+
+// Shifts returns the shifts of all enabled schedules that overlap the period between from and until
+func (provider *opsgenieProvider) Shifts(from time.Time, until time.Time) ([]Shift, error) {
+
+	schedules, err := provider.listSchedules()
+	if err != nil {
+		return nil, err
+	}
+
+	// The timeline is requested in whole days starting at from
+	days := int(until.Sub(from).Hours()/24) + 1
+	query := url.Values{}
+	query.Set("date", from.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"))
+	query.Set("interval", strconv.Itoa(days))
+	query.Set("intervalUnit", "days")
+
+	var shifts []Shift
+	for _, schedule := range schedules {
+		var timeline struct {
+			Data opsgenieTimeline `json:"data"`
+		}
+		if err := provider.apiRequest("/v2/schedules/"+url.PathEscape(schedule.ID)+"/timeline", query, &timeline); err != nil {
+			return nil, err
+		}
+
+		scheduleObject := opsgenieToSchedule(schedule).APIObject
+		for _, rotation := range timeline.Data.FinalTimeline.Rotations {
+			for _, period := range rotation.Periods {
+				if period.Recipient.Type != "user" {
+					continue
+				}
+
+				start, err := time.Parse(time.RFC3339, period.StartDate)
+				if err != nil {
+					return nil, err
+				}
+				end, err := time.Parse(time.RFC3339, period.EndDate)
+				if err != nil {
+					return nil, err
+				}
+				if !start.Before(until) || !end.After(from) {
+					continue
+				}
+
+				shifts = append(shifts, Shift{
+					Schedule: scheduleObject,
+					User:     pagerduty.APIObject{ID: period.Recipient.ID, Type: "user_reference", Summary: period.Recipient.Name},
+					Start:    start,
+					End:      end,
+				})
+			}
+		}
+	}
+	return shifts, nil
+}
+
+// UserShifts returns the shifts of a single user, opsgenie timelines can't be filtered by user
+func (provider *opsgenieProvider) UserShifts(userID string, from time.Time, until time.Time) ([]Shift, error) {
+	shifts, err := provider.Shifts(from, until)
+	if err != nil {
+		return nil, err
+	}
+	return filterUserShifts(shifts, userID), nil
+}
+
+// Users returns every user in the opsgenie account
+func (provider *opsgenieProvider) Users() ([]pagerduty.User, error) {
+
+	var users []pagerduty.User
+	query := url.Values{}
+	query.Set("limit", "100")
+
+	for offset := 0; ; offset += 100 {
+		query.Set("offset", strconv.Itoa(offset))
+
+		var listUsersResponse struct {
+			Data       []opsgenieUser `json:"data"`
+			TotalCount int            `json:"totalCount"`
+		}
+		if err := provider.apiRequest("/v2/users", query, &listUsersResponse); err != nil {
+			return nil, err
+		}
+		for _, user := range listUsersResponse.Data {
+			users = append(users, opsgenieToUser(user))
+		}
+
+		if len(listUsersResponse.Data) == 0 || offset+len(listUsersResponse.Data) >= listUsersResponse.TotalCount {
+			break
+		}
+	}
+	return users, nil
+}
+
+// ContactMethods returns the contacts of a user, as pagerduty contact method types
+func (provider *opsgenieProvider) ContactMethods(userID string) ([]pagerduty.ContactMethod, error) {
+
+	var contactsResponse struct {
+		Data []opsgenieContact `json:"data"`
+	}
+	if err := provider.apiRequest("/v2/users/"+url.PathEscape(userID)+"/contacts", nil, &contactsResponse); err != nil {
+		return nil, err
+	}
+
+	var contactMethods []pagerduty.ContactMethod
+	for _, contact := range contactsResponse.Data {
+		var contactType string
+		switch contact.Method {
+		case "voice", "mobile":
+			contactType = "phone_contact_method"
+		case "sms":
+			contactType = "sms_contact_method"
+		case "email":
+			contactType = "email_contact_method"
+		default:
+			continue
+		}
+		contactMethods = append(contactMethods, pagerduty.ContactMethod{ID: contact.ID, Type: contactType, Address: contact.To})
+	}
+	return contactMethods, nil
+}
+
+// getUser returns a user with their contact methods
+func (provider *opsgenieProvider) getUser(userID string) (pagerduty.User, error) {
+
+	var userResponse struct {
+		Data opsgenieUser `json:"data"`
+	}
+	if err := provider.apiRequest("/v2/users/"+url.PathEscape(userID), nil, &userResponse); err != nil {
+		return pagerduty.User{}, err
+	}
+
+	user := opsgenieToUser(userResponse.Data)
+	contactMethods, err := provider.ContactMethods(userID)
+	if err != nil {
+		return pagerduty.User{}, err
+	}
+	user.ContactMethods = contactMethods
+	return user, nil
+}
+
+func (provider *opsgenieProvider) listSchedules() ([]opsgenieSchedule, error) {
+
+	var schedulesResponse struct {
+		Data []opsgenieSchedule `json:"data"`
+	}
+	if err := provider.apiRequest("/v2/schedules", nil, &schedulesResponse); err != nil {
+		return nil, err
+	}
+
+	var schedules []opsgenieSchedule
+	for _, schedule := range schedulesResponse.Data {
+		if schedule.Enabled {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return schedules, nil
+}
+
+// apiRequest does a GET request to the opsgenie REST API and decodes the response into result
+func (provider *opsgenieProvider) apiRequest(path string, query url.Values, result interface{}) error {
+	return withBackoff(func() error {
+		return provider.doAPIRequest(path, query, result)
+	})
+}
+
+func (provider *opsgenieProvider) doAPIRequest(path string, query url.Values, result interface{}) error {
+
+	requestURL := provider.apiURL + path
+	if len(query) > 0 {
+		requestURL = requestURL + "?" + query.Encode()
+	}
+
+	request, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "GenieKey "+provider.apiKey)
+
+	response, err := provider.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return newAPIError("opsgenie", "GET", path, response)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func opsgenieToUser(user opsgenieUser) pagerduty.User {
+	return pagerduty.User{
+		APIObject: pagerduty.APIObject{ID: user.ID, Type: "user", Summary: user.FullName},
+		Name:      user.FullName,
+		Email:     user.Username,
+	}
+}
+
+func opsgenieToSchedule(schedule opsgenieSchedule) pagerduty.Schedule {
+	return pagerduty.Schedule{
+		APIObject: pagerduty.APIObject{ID: schedule.ID, Type: "schedule", Summary: schedule.Name},
+		Name:      schedule.Name,
+	}
+}
@@ -0,0 +1,147 @@
+package schedules
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// opsgenieStandIn serves two schedules, one of them disabled, with a user on call in the enabled one
+func opsgenieStandIn(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "GenieKey test-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var response interface{}
+		switch r.URL.Path {
+		case "/v2/schedules":
+			response = map[string]interface{}{"data": []map[string]interface{}{
+				{"id": "S1", "name": "Platform", "enabled": true},
+				{"id": "S2", "name": "Retired", "enabled": false},
+			}}
+		case "/v2/schedules/S1/on-calls":
+			response = map[string]interface{}{"data": map[string]interface{}{"onCallParticipants": []map[string]string{
+				{"id": "U1", "name": "jane@example.com", "type": "user"},
+				{"id": "T1", "name": "Platform team", "type": "team"},
+			}}}
+		case "/v2/schedules/S1/timeline":
+			if r.URL.Query().Get("interval") != "4" || r.URL.Query().Get("intervalUnit") != "days" {
+				t.Errorf("unexpected timeline query %s", r.URL.RawQuery)
+			}
+			response = map[string]interface{}{"data": map[string]interface{}{"finalTimeline": map[string]interface{}{"rotations": []map[string]interface{}{{
+				"periods": []map[string]interface{}{
+					{"startDate": "2026-10-19T07:00:00Z", "endDate": "2026-10-21T07:00:00Z", "recipient": map[string]string{"id": "U1", "name": "jane@example.com", "type": "user"}},
+					{"startDate": "2026-10-21T07:00:00Z", "endDate": "2026-10-23T07:00:00Z", "recipient": map[string]string{"id": "U2", "name": "john@example.com", "type": "user"}},
+					{"startDate": "2026-10-23T07:00:00Z", "endDate": "2026-10-25T07:00:00Z", "recipient": map[string]string{"id": "T1", "name": "Platform team", "type": "team"}},
+					{"startDate": "2026-10-30T07:00:00Z", "endDate": "2026-11-01T07:00:00Z", "recipient": map[string]string{"id": "U1", "name": "jane@example.com", "type": "user"}},
+				},
+			}}}}}
+		case "/v2/users":
+			users := []map[string]string{{"id": "U1", "username": "jane@example.com", "fullName": "Jane Doe"}}
+			if r.URL.Query().Get("offset") == "100" {
+				users = []map[string]string{{"id": "U2", "username": "john@example.com", "fullName": "John Doe"}}
+			}
+			response = map[string]interface{}{"data": users, "totalCount": 101}
+		case "/v2/users/U1":
+			response = map[string]interface{}{"data": map[string]string{"id": "U1", "username": "jane@example.com", "fullName": "Jane Doe"}}
+		case "/v2/users/U1/contacts":
+			response = map[string]interface{}{"data": []map[string]string{
+				{"id": "C1", "method": "voice", "to": "31-612345678"},
+				{"id": "C2", "method": "sms", "to": "31-612345678"},
+				{"id": "C3", "method": "email", "to": "jane@example.com"},
+				{"id": "C4", "method": "slack", "to": "@jane"},
+			}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestOpsgenieProvider(t *testing.T) {
+
+	server := opsgenieStandIn(t)
+	defer server.Close()
+	provider := newOpsgenieProvider("test-key", server.URL, server.Client())
+
+	onCallUsers, err := provider.CurrentOnCall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onCallUsers) != 1 {
+		t.Fatalf("got %d users on call, only the user in the enabled schedule is", len(onCallUsers))
+	}
+	user := onCallUsers[0]
+	if user.User.Name != "Jane Doe" || user.User.Email != "jane@example.com" || user.Schedule.Name != "Platform" {
+		t.Errorf("got %+v", user)
+	}
+	if len(user.User.ContactMethods) != 3 || user.User.ContactMethods[0].Type != "phone_contact_method" || user.User.ContactMethods[1].Type != "sms_contact_method" {
+		t.Errorf("got contact methods %+v", user.User.ContactMethods)
+	}
+
+	from := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	shifts, err := provider.Shifts(from, from.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shifts) != 2 || shifts[0].User.ID != "U1" || shifts[1].User.ID != "U2" || shifts[0].Schedule.Summary != "Platform" {
+		t.Errorf("got shifts %+v", shifts)
+	}
+
+	userShifts, err := provider.UserShifts("U2", from, from.AddDate(0, 0, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userShifts) != 1 || userShifts[0].User.ID != "U2" || !userShifts[0].Start.Equal(time.Date(2026, 10, 21, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("got user shifts %+v", userShifts)
+	}
+
+	users, err := provider.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[1].Email != "john@example.com" {
+		t.Errorf("got users %+v, expected both pages", users)
+	}
+}
+
+func TestOpsgenieErrors(t *testing.T) {
+
+	server := opsgenieStandIn(t)
+	defer server.Close()
+
+	provider := newOpsgenieProvider("wrong-key", server.URL, server.Client())
+	if _, err := provider.CurrentOnCall(); err == nil || !strings.Contains(err.Error(), "HTTP status 401") {
+		t.Errorf("got error %v with the wrong key", err)
+	}
+
+	provider = newOpsgenieProvider("test-key", server.URL, server.Client())
+	if _, err := provider.ContactMethods("U3"); err == nil || !strings.Contains(err.Error(), "HTTP status 404") {
+		t.Errorf("got error %v for an unknown user", err)
+	}
+
+	// A request that hangs gives up after the timeout of the client
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer hanging.Close()
+	provider = newOpsgenieProvider("test-key", hanging.URL, &http.Client{Timeout: 50 * time.Millisecond})
+	if _, err := provider.Users(); err == nil {
+		t.Error("expected an error when opsgenie doesn't answer")
+	}
+
+	client := &Client{Provider: "opsgenie"}
+	opsgenie, err := client.newProvider("test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opsgenie.(*opsgenieProvider).httpClient.Timeout == 0 {
+		t.Error("the opsgenie provider has no timeout")
+	}
+}
@@ -0,0 +1,310 @@
+package schedules
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/wvdeutekom/go-pagerduty"
+	"github.com/wvdeutekom/molliebot/dates"
+)
+
+// pagerdutyProvider reads the on-call schedules from pagerduty
+type pagerdutyProvider struct {
+	pagerdutyClient *pagerduty.Client
+	// For the calls go-pagerduty does not support
+	api   *Client
+	users userCache
+}
+
+func newPagerdutyProvider(pagerdutyClient *pagerduty.Client, api *Client) *pagerdutyProvider {
+	return &pagerdutyProvider{pagerdutyClient: pagerdutyClient, api: api}
+}
+
+func (provider *pagerdutyProvider) Name() string {
+	return "PagerDuty"
+}
+
+// CurrentOnCall fetches who is on call in every schedule, with their details, with a single on-calls request.
+// The contact methods of those users are fetched with a bounded number of concurrent requests.
+func (provider *pagerdutyProvider) CurrentOnCall() ([]OnCallUser, error) {
+
+	schedules, err := provider.getAllSchedules(false)
+	if err != nil {
+		return nil, err
+	}
+
+	schedulesByID := make(map[string]pagerduty.Schedule)
+	var scheduleIds []string
+	for _, schedule := range schedules {
+		schedulesByID[schedule.ID] = schedule
+		scheduleIds = append(scheduleIds, schedule.ID)
+	}
+
+	now := time.Now()
+	onCalls, err := provider.listOncalls(now, now.Add(time.Second), scheduleIds, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// A schedule used in several escalation policies or levels shows up once for each of them
+	seen := make(map[string]bool)
+	var scheduleOnCalls []onCallEntry
+	var userIDs []string
+	includedUsers := make(map[string]pagerduty.User)
+	for _, onCall := range onCalls {
+		key := onCall.Schedule.ID + onCall.User.ID
+		if onCall.Schedule.ID == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		scheduleOnCalls = append(scheduleOnCalls, onCall)
+		userIDs = append(userIDs, onCall.User.ID)
+		includedUsers[onCall.User.ID] = onCall.User
+	}
+
+	users, err := getUsers(&provider.users, userIDs, func(userID string) (pagerduty.User, error) {
+		return provider.withContactMethods(includedUsers[userID])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var onCallUsers []OnCallUser
+	for _, onCall := range scheduleOnCalls {
+		onCallUsers = append(onCallUsers, OnCallUser{users[onCall.User.ID], schedulesByID[onCall.Schedule.ID]})
+	}
+	return onCallUsers, nil
+}
+
+// Shifts returns the shifts of all schedules that overlap the period between from and until
+func (provider *pagerdutyProvider) Shifts(from time.Time, until time.Time) ([]Shift, error) {
+	return provider.shifts(from, until, nil)
+}
+
+// UserShifts lets pagerduty filter the on-call entries by user, instead of listing everyone's shifts
+func (provider *pagerdutyProvider) UserShifts(userID string, from time.Time, until time.Time) ([]Shift, error) {
+	return provider.shifts(from, until, []string{userID})
+}
+
+func (provider *pagerdutyProvider) shifts(from time.Time, until time.Time, userIds []string) ([]Shift, error) {
+
+	schedules, err := provider.getAllSchedules(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var scheduleIds []string
+	for _, schedule := range schedules {
+		scheduleIds = append(scheduleIds, schedule.ID)
+	}
+
+	onCalls, err := provider.listOncalls(from, until, scheduleIds, userIds)
+	if err != nil {
+		return nil, err
+	}
+
+	// A schedule used in several escalation levels shows up once per level, only keep one
+	seen := make(map[string]bool)
+
+	var shifts []Shift
+	for _, onCall := range onCalls {
+		if onCall.Schedule.ID == "" {
+			continue
+		}
+
+		key := onCall.Schedule.ID + onCall.User.ID + onCall.Start
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		shifts = append(shifts, Shift{
+			Schedule: onCall.Schedule,
+			User:     onCall.User.APIObject,
+			Start:    dates.StringToDate(onCall.Start, dates.StringToDateOptions{Format: "2006-01-02T15:04:05Z07:00"}),
+			End:      dates.StringToDate(onCall.End, dates.StringToDateOptions{Format: "2006-01-02T15:04:05Z07:00"}),
+		})
+	}
+	return shifts, nil
+}
+
+// Users returns every user in the pagerduty account
+func (provider *pagerdutyProvider) Users() ([]pagerduty.User, error) {
+
+	var users []pagerduty.User
+	var usersOpts pagerduty.ListUsersOptions
+
+	for {
+		var listUsersResponse *pagerduty.ListUsersResponse
+		err := withBackoff(func() (err error) {
+			listUsersResponse, err = provider.pagerdutyClient.ListUsers(usersOpts)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, listUsersResponse.Users...)
+
+		if !listUsersResponse.More {
+			break
+		}
+		usersOpts.Offset = listUsersResponse.Offset + listUsersResponse.Limit
+	}
+	return users, nil
+}
+
+func (provider *pagerdutyProvider) ContactMethods(userID string) ([]pagerduty.ContactMethod, error) {
+	var contactMethodResponse *pagerduty.ContactMethodResponse
+	err := withBackoff(func() (err error) {
+		contactMethodResponse, err = provider.pagerdutyClient.GetUserContactMethod(userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contactMethodResponse.ContactMethods, nil
+}
+
+// withContactMethods returns the user with their contact methods
+func (provider *pagerdutyProvider) withContactMethods(user pagerduty.User) (pagerduty.User, error) {
+	contactMethods, err := provider.ContactMethods(user.ID)
+	if err != nil {
+		return pagerduty.User{}, err
+	}
+	user.ContactMethods = contactMethods
+	return user, nil
+}
+
+// onCallEntry is an on-call entry with the details of the user, go-pagerduty only decodes the reference to the user
+type onCallEntry struct {
+	pagerduty.OnCall
+	User pagerduty.User `json:"user"`
+}
+
+// onCallsPage is a page of the on-calls list, go-pagerduty doesn't return whether there are more
+type onCallsPage struct {
+	OnCalls []onCallEntry `json:"oncalls"`
+	Offset  int           `json:"offset"`
+	More    bool          `json:"more"`
+}
+
+// listOncalls returns the on-call entries between from and until with their users, of all pages.
+// The entries are limited to the given schedules and users, when there are any.
+func (provider *pagerdutyProvider) listOncalls(from time.Time, until time.Time, scheduleIds []string, userIds []string) ([]onCallEntry, error) {
+
+	query := url.Values{}
+	query.Set("since", from.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"))
+	query.Set("until", until.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"))
+	for _, scheduleId := range scheduleIds {
+		query.Add("schedule_ids[]", scheduleId)
+	}
+	for _, userId := range userIds {
+		query.Add("user_ids[]", userId)
+	}
+	// The default page size of 25 is easily exceeded when listing a week for every schedule
+	query.Set("limit", "100")
+	query.Set("include[]", "users")
+
+	var onCalls []onCallEntry
+	for offset := 0; ; {
+		query.Set("offset", strconv.Itoa(offset))
+
+		var page onCallsPage
+		if err := provider.api.apiRequest("GET", "/oncalls?"+query.Encode(), "", nil, &page); err != nil {
+			return nil, err
+		}
+		onCalls = append(onCalls, page.OnCalls...)
+
+		if !page.More || len(page.OnCalls) == 0 {
+			break
+		}
+		offset = page.Offset + len(page.OnCalls)
+	}
+	return onCalls, nil
+}
+
+type scheduleResult struct {
+	schedule pagerduty.Schedule
+	err      error
+}
+
+// getAllSchedules returns the schedules, with their layers and entries when withDetail is set.
+// Every call gets its own list, the provider is used by several goroutines at the same time.
+func (provider *pagerdutyProvider) getAllSchedules(withDetail bool) ([]pagerduty.Schedule, error) {
+	schedules, err := provider.getScheduleList()
+	if err != nil {
+		return nil, err
+	}
+
+	if withDetail {
+		var c chan scheduleResult = make(chan scheduleResult)
+		for _, schedule := range schedules {
+			go provider.getSchedule(schedule, c)
+		}
+		return collectSchedules(c, len(schedules))
+	}
+	return schedules, nil
+}
+
+// collectSchedules returns count detailed schedules, if fetching any of them failed the first error is returned
+func collectSchedules(c <-chan scheduleResult, count int) ([]pagerduty.Schedule, error) {
+	var schedules []pagerduty.Schedule
+	var firstErr error
+	for i := 0; i < count; i++ {
+		result := <-c
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		schedules = append(schedules, result.schedule)
+	}
+	return schedules, firstErr
+}
+
+// schedulesPage is a page of the schedules list
+type schedulesPage struct {
+	Schedules []pagerduty.Schedule `json:"schedules"`
+	Offset    int                  `json:"offset"`
+	More      bool                 `json:"more"`
+}
+
+// getScheduleList fetches the list of schedules, of all pages
+func (provider *pagerdutyProvider) getScheduleList() ([]pagerduty.Schedule, error) {
+
+	query := url.Values{}
+	query.Set("limit", "100")
+
+	var schedules []pagerduty.Schedule
+	for offset := 0; ; {
+		query.Set("offset", strconv.Itoa(offset))
+
+		var page schedulesPage
+		if err := provider.api.apiRequest("GET", "/schedules?"+query.Encode(), "", nil, &page); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, page.Schedules...)
+
+		if !page.More || len(page.Schedules) == 0 {
+			break
+		}
+		offset = page.Offset + len(page.Schedules)
+	}
+	return schedules, nil
+}
+
+func (provider *pagerdutyProvider) getSchedule(schedule pagerduty.Schedule, c chan<- scheduleResult) {
+
+	var detailedSchedule *pagerduty.Schedule
+	err := withBackoff(func() (err error) {
+		detailedSchedule, err = provider.pagerdutyClient.GetSchedule(schedule.ID, pagerduty.GetScheduleOptions{})
+		return err
+	})
+	if err != nil {
+		c <- scheduleResult{err: err}
+		return
+	}
+	c <- scheduleResult{schedule: *detailedSchedule}
+}
@@ -0,0 +1,56 @@
+package schedules
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wvdeutekom/go-pagerduty"
+)
+
+// OnCallProvider is where the on-call schedules are read from.
+// Users and schedules are described with the pagerduty types, whatever the provider.
+type OnCallProvider interface {
+	// Name is used in messages, e.g. when the provider is unreachable
+	Name() string
+	// CurrentOnCall returns who is on call right now in every schedule, with their contact methods
+	CurrentOnCall() ([]OnCallUser, error)
+	// Shifts returns the shifts of all schedules that overlap the period between from and until
+	Shifts(from time.Time, until time.Time) ([]Shift, error)
+	// UserShifts returns the shifts of a single user that overlap the period between from and until
+	UserShifts(userID string, from time.Time, until time.Time) ([]Shift, error)
+	// Users returns every user that can be on call
+	Users() ([]pagerduty.User, error)
+	// ContactMethods returns how a user can be reached
+	ContactMethods(userID string) ([]pagerduty.ContactMethod, error)
+}
+
+// newProvider returns the provider configured in the provider setting, pagerduty by default
+func (client *Client) newProvider(opsgenieApiKey string) (OnCallProvider, error) {
+	switch client.Provider {
+	case "", "pagerduty":
+		return newPagerdutyProvider(client.pagerdutyClient, client), nil
+	case "opsgenie":
+		return newOpsgenieProvider(opsgenieApiKey, client.OpsgenieURL, client.httpClient()), nil
+	case "rota":
+		return newRotaProvider(client.RotaFile), nil
+	}
+	return nil, fmt.Errorf("'%s' is not an on-call provider, use pagerduty, opsgenie or rota", client.Provider)
+}
+
+// UsesPagerduty reports whether the on-call schedules are read from pagerduty.
+// Shifts can only be swapped when they are, the overrides are created in pagerduty.
+func (client *Client) UsesPagerduty() bool {
+	_, ok := client.onCallProvider().(*pagerdutyProvider)
+	return ok
+}
+
+// filterUserShifts returns the shifts of a single user, for the providers that can't filter by user themselves
+func filterUserShifts(shifts []Shift, userID string) []Shift {
+	var userShifts []Shift
+	for _, shift := range shifts {
+		if shift.User.ID == userID {
+			userShifts = append(userShifts, shift)
+		}
+	}
+	return userShifts
+}
@@ -0,0 +1,224 @@
+package schedules
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wvdeutekom/go-pagerduty"
+	"gopkg.in/yaml.v2"
+)
+
+// rotaProvider reads the on-call shifts from a YAML or CSV file, for teams without an on-call service.
+// The file is read on every request, so changes are picked up without a restart.
+//
+// YAML:
+//
+//	shifts:
+//	  - schedule: Platform
+//	    name: Jane Doe
+//	    email: jane@example.com
+//	    phone: "+31612345678"
+//	    start: "2026-10-19T09:00:00+02:00"
+//	    end: "2026-10-26T09:00:00+02:00"
+//
+// CSV, with a header line:
+//
+//	schedule,name,email,phone,start,end
+type rotaProvider struct {
+	file string
+}
+
+type rotaShift struct {
+	Schedule string `yaml:"schedule"`
+	Name     string `yaml:"name"`
+	Email    string `yaml:"email"`
+	Phone    string `yaml:"phone"`
+	Start    string `yaml:"start"`
+	End      string `yaml:"end"`
+
+	start time.Time
+	end   time.Time
+}
+
+func newRotaProvider(file string) *rotaProvider {
+	return &rotaProvider{file: file}
+}
+
+func (provider *rotaProvider) Name() string {
+	return "The rota file"
+}
+
+func (provider *rotaProvider) CurrentOnCall() ([]OnCallUser, error) {
+
+	rotaShifts, err := provider.readShifts()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var onCallUsers []OnCallUser
+	for _, rotaShift := range rotaShifts {
+		if rotaShift.start.After(now) || !rotaShift.end.After(now) {
+			continue
+		}
+		onCallUsers = append(onCallUsers, OnCallUser{rotaShift.user(), rotaShift.schedule()})
+	}
+	return onCallUsers, nil
+}
+
+func (provider *rotaProvider) Shifts(from time.Time, until time.Time) ([]Shift, error) {
+
+	rotaShifts, err := provider.readShifts()
+	if err != nil {
+		return nil, err
+	}
+
+	var shifts []Shift
+	for _, rotaShift := range rotaShifts {
+		if !rotaShift.start.Before(until) || !rotaShift.end.After(from) {
+			continue
+		}
+		shifts = append(shifts, Shift{
+			Schedule: rotaShift.schedule().APIObject,
+			User:     rotaShift.user().APIObject,
+			Start:    rotaShift.start,
+			End:      rotaShift.end,
+		})
+	}
+	return shifts, nil
+}
+
+func (provider *rotaProvider) UserShifts(userID string, from time.Time, until time.Time) ([]Shift, error) {
+	shifts, err := provider.Shifts(from, until)
+	if err != nil {
+		return nil, err
+	}
+	return filterUserShifts(shifts, userID), nil
+}
+
+// Users returns everyone who has a shift in the rota
+func (provider *rotaProvider) Users() ([]pagerduty.User, error) {
+
+	rotaShifts, err := provider.readShifts()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var users []pagerduty.User
+	for _, rotaShift := range rotaShifts {
+		user := rotaShift.user()
+		if !seen[user.ID] {
+			seen[user.ID] = true
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (provider *rotaProvider) ContactMethods(userID string) ([]pagerduty.ContactMethod, error) {
+
+	users, err := provider.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.ID == userID {
+			return user.ContactMethods, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no %s in the rota", userID)
+}
+
+func (provider *rotaProvider) readShifts() ([]rotaShift, error) {
+
+	if provider.file == "" {
+		return nil, fmt.Errorf("no rota_file configured")
+	}
+
+	content, err := ioutil.ReadFile(provider.file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rotaShifts []rotaShift
+	switch strings.ToLower(filepath.Ext(provider.file)) {
+	case ".csv":
+		rotaShifts, err = parseRotaCSV(content)
+	case ".yml", ".yaml":
+		var rota struct {
+			Shifts []rotaShift `yaml:"shifts"`
+		}
+		err = yaml.Unmarshal(content, &rota)
+		rotaShifts = rota.Shifts
+	default:
+		err = fmt.Errorf("rota file %s is not a .yaml, .yml or .csv file", provider.file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rotaShifts {
+		if rotaShifts[i].start, err = time.Parse(time.RFC3339, rotaShifts[i].Start); err != nil {
+			return nil, fmt.Errorf("shift %d in %s: %v", i+1, provider.file, err)
+		}
+		if rotaShifts[i].end, err = time.Parse(time.RFC3339, rotaShifts[i].End); err != nil {
+			return nil, fmt.Errorf("shift %d in %s: %v", i+1, provider.file, err)
+		}
+	}
+	return rotaShifts, nil
+}
+
+func parseRotaCSV(content []byte) ([]rotaShift, error) {
+
+	records, err := csv.NewReader(strings.NewReader(string(content))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var rotaShifts []rotaShift
+	for i, record := range records {
+		// The first line is the header
+		if i == 0 {
+			continue
+		}
+		if len(record) != 6 {
+			return nil, fmt.Errorf("line %d of the rota has %d columns instead of schedule,name,email,phone,start,end", i+1, len(record))
+		}
+		rotaShifts = append(rotaShifts, rotaShift{
+			Schedule: record[0],
+			Name:     record[1],
+			Email:    record[2],
+			Phone:    record[3],
+			Start:    record[4],
+			End:      record[5],
+		})
+	}
+	return rotaShifts, nil
+}
+
+// user returns the person on call in the shift, identified by their email address
+func (rotaShift rotaShift) user() pagerduty.User {
+
+	user := pagerduty.User{
+		APIObject: pagerduty.APIObject{ID: strings.ToLower(rotaShift.Email), Type: "user", Summary: rotaShift.Name},
+		Name:      rotaShift.Name,
+		Email:     rotaShift.Email,
+	}
+	if rotaShift.Phone != "" {
+		user.ContactMethods = []pagerduty.ContactMethod{{Type: "phone_contact_method", Address: rotaShift.Phone}}
+	}
+	return user
+}
+
+func (rotaShift rotaShift) schedule() pagerduty.Schedule {
+	return pagerduty.Schedule{
+		APIObject: pagerduty.APIObject{ID: rotaShift.Schedule, Type: "schedule", Summary: rotaShift.Schedule},
+		Name:      rotaShift.Schedule,
+	}
+}
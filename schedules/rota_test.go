@@ -0,0 +1,142 @@
+package schedules
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rotaCSV = `schedule,name,email,phone,start,end
+Platform,Jane Doe,Jane@Example.com,+31612345678,2026-10-19T09:00:00+02:00,2026-10-26T09:00:00+01:00
+Platform,John Doe,john@example.com,,2026-10-26T09:00:00+01:00,2026-11-02T09:00:00+01:00
+Payments,Jane Doe,jane@example.com,+31612345678,2026-10-22T18:00:00+02:00,2026-10-23T09:00:00+02:00
+`
+
+const rotaYAML = `shifts:
+  - schedule: Platform
+    name: Jane Doe
+    email: Jane@Example.com
+    phone: "+31612345678"
+    start: "2026-10-19T09:00:00+02:00"
+    end: "2026-10-26T09:00:00+01:00"
+  - schedule: Platform
+    name: John Doe
+    email: john@example.com
+    start: "2026-10-26T09:00:00+01:00"
+    end: "2026-11-02T09:00:00+01:00"
+  - schedule: Payments
+    name: Jane Doe
+    email: jane@example.com
+    phone: "+31612345678"
+    start: "2026-10-22T18:00:00+02:00"
+    end: "2026-10-23T09:00:00+02:00"
+`
+
+// writeRota writes a rota file with the given name to a temporary directory, the directory must be removed after the test
+func writeRota(t *testing.T, name string, content string) (string, string) {
+	dir, err := ioutil.TempDir("", "rota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, file
+}
+
+func TestRotaShifts(t *testing.T) {
+
+	for _, rota := range []struct{ name, content string }{{"rota.csv", rotaCSV}, {"rota.yaml", rotaYAML}, {"rota.YML", rotaYAML}} {
+		dir, file := writeRota(t, rota.name, rota.content)
+		defer os.RemoveAll(dir)
+		provider := newRotaProvider(file)
+
+		from := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+		shifts, err := provider.Shifts(from, from.AddDate(0, 0, 3))
+		if err != nil {
+			t.Fatalf("%s: %v", rota.name, err)
+		}
+		if len(shifts) != 2 {
+			t.Fatalf("%s: got %d shifts instead of the 2 that overlap: %+v", rota.name, len(shifts), shifts)
+		}
+		shift := shifts[0]
+		if shift.Schedule.ID != "Platform" || shift.User.ID != "jane@example.com" || shift.User.Summary != "Jane Doe" {
+			t.Errorf("%s: got shift %+v", rota.name, shift)
+		}
+		if !shift.Start.Equal(time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC)) || !shift.End.Equal(time.Date(2026, 10, 26, 8, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: got shift from %v until %v", rota.name, shift.Start, shift.End)
+		}
+
+		userShifts, err := provider.UserShifts("john@example.com", from, from.AddDate(0, 0, 14))
+		if err != nil {
+			t.Fatalf("%s: %v", rota.name, err)
+		}
+		if len(userShifts) != 1 || userShifts[0].User.Summary != "John Doe" {
+			t.Errorf("%s: got shifts %+v for John", rota.name, userShifts)
+		}
+
+		users, err := provider.Users()
+		if err != nil {
+			t.Fatalf("%s: %v", rota.name, err)
+		}
+		if len(users) != 2 {
+			t.Errorf("%s: got users %+v, Jane should be listed once", rota.name, users)
+		}
+
+		contactMethods, err := provider.ContactMethods("jane@example.com")
+		if err != nil {
+			t.Fatalf("%s: %v", rota.name, err)
+		}
+		if len(contactMethods) != 1 || contactMethods[0].Address != "+31612345678" {
+			t.Errorf("%s: got contact methods %+v for Jane", rota.name, contactMethods)
+		}
+	}
+}
+
+func TestRotaErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"rota.csv", "schedule,name,email,phone,start,end\nPlatform,Jane Doe,jane@example.com\n", "wrong number of fields"},
+		{"rota.csv", "schedule,name,email,phone,start,end\nPlatform,Jane Doe,jane@example.com,,2026-10-19 09:00,2026-10-26T09:00:00+01:00\n", "shift 1 in"},
+		{"rota.yaml", "shifts:\n  - schedule: Platform\n    start: 2026-10-19T09:00:00+02:00\n    end: tomorrow\n", "shift 1 in"},
+		{"rota.yaml", "shifts: [", "yaml"},
+		{"rota.txt", rotaCSV, "is not a .yaml, .yml or .csv file"},
+	}
+
+	for _, test := range tests {
+		dir, file := writeRota(t, test.name, test.content)
+		defer os.RemoveAll(dir)
+
+		_, err := newRotaProvider(file).Shifts(time.Now(), time.Now().AddDate(0, 0, 7))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s %q: got error %v, expected %q", test.name, test.content, err, test.err)
+		}
+	}
+
+	if _, err := newRotaProvider("").Shifts(time.Now(), time.Now()); err == nil {
+		t.Error("expected an error without a rota file")
+	}
+	if _, err := newRotaProvider("/does/not/exist.csv").Shifts(time.Now(), time.Now()); err == nil {
+		t.Error("expected an error for a missing rota file")
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+
+	for _, name := range []string{"", "pagerduty", "opsgenie", "rota"} {
+		if _, err := (&Client{Provider: name}).newProvider(""); err != nil {
+			t.Errorf("provider %q: %v", name, err)
+		}
+	}
+	if _, err := (&Client{Provider: "victorops"}).newProvider(""); err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+}
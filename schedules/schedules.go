@@ -2,157 +2,481 @@ package schedules
 
 import (
 	"fmt"
-	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/spf13/viper"
+	"github.com/sirupsen/logrus"
 	"github.com/wvdeutekom/go-pagerduty"
 	"github.com/wvdeutekom/molliebot/dates"
+	"github.com/wvdeutekom/molliebot/helpers"
 )
 
 type Client struct {
 	pagerdutyClient *pagerduty.Client
-	Schedules       []pagerduty.Schedule
-	onCallUsers     []pagerduty.User
+	APIKey          string `mapstructure:"api_key"`
+	provider        OnCallProvider
+	onCall          onCallCache
 	ReportChannels  []string `mapstructure:"report_channels"`
+
+	// Guards ReportChannels, which are replaced when the config is reloaded
+	reportChannelsMutex sync.RWMutex
+	// Guards the API keys, pagerdutyClient and provider, which are replaced when a key is rotated
+	keysMutex sync.RWMutex
+
+	// Where the on-call schedules are read from: pagerduty (default), opsgenie or rota.
+	// Incidents and paging always use pagerduty, shifts can only be swapped when the schedules are in pagerduty.
+	Provider string `mapstructure:"provider"`
+
+	// Opsgenie API URL, https://api.eu.opsgenie.com for accounts in the EU
+	OpsgenieURL    string `mapstructure:"opsgenie_url"`
+	OpsgenieAPIKey string `mapstructure:"opsgenie_api_key"`
+
+	// YAML or CSV file with the on-call shifts, used by the rota provider
+	RotaFile string `mapstructure:"rota_file"`
+
+	// How long the on-call users are cached before they are refreshed on request, 10 minutes by default
+	OnCallTTLMinutes int `mapstructure:"on_call_ttl_minutes"`
+
+	// Slack channel ID -> team or schedule name that is used when on-call questions are asked in that channel
+	ChannelTeams map[string]string `mapstructure:"channel_teams"`
+
+	// Services that can be paged from slack
+	PageTargets []PageTarget `mapstructure:"page_targets"`
+
+	// Public holidays as 'YYYY-MM-DD', on-call hours on these days count as holiday hours in the fairness report
+	Holidays []string `mapstructure:"holidays"`
+
+	// The pagerduty API and the HTTP client used for the calls go-pagerduty does not support, like incidents and on-calls.
+	// They are only set in tests, to use a stand-in for pagerduty.
+	APIURL     string       `mapstructure:"-"`
+	HTTPClient *http.Client `mapstructure:"-"`
+
+	// FormatUserName is used to display on-call users in messages, e.g. as a Slack mention.
+	// When not set the pagerduty name of the user is used.
+	FormatUserName func(user pagerduty.User) string
 }
 
 //TODO:
-// * Chat: Get persons on call for a given date. E.g. "Who is on call next week", return the entire week and all the people on call in every team. USE client.ListOnCalls
 // * Administration: collect the entire pagerduty schedule from pagerduty. Make a list and send it to @wijnand every month
 
-func New(apiKey string, configLocation string) *Client {
-	client := &Client{}
-	client.readConfig(configLocation, client)
-	client.pagerdutyClient = pagerduty.NewClient(apiKey)
-	return client
+// Setup creates the pagerduty client and the on-call provider from the settings
+func (client *Client) Setup() error {
+	client.keysMutex.Lock()
+	defer client.keysMutex.Unlock()
+	return client.setupProvider()
 }
 
-func (client *Client) readConfig(configLocation string, clientInstance *Client) error {
-	viper.SetConfigFile(configLocation)
-
-	err := viper.ReadInConfig()
+func (client *Client) setupProvider() error {
+	client.pagerdutyClient = pagerduty.NewClient(client.APIKey)
+	provider, err := client.newProvider(client.OpsgenieAPIKey)
 	if err != nil {
-		log.Println("No configuration file loaded: %v\n", err)
 		return err
 	}
+	client.provider = provider
+	return nil
+}
 
-	// Read config into Client struct
-	err = viper.UnmarshalKey("pagerduty", &clientInstance)
-	if err != nil {
-		log.Println("Unable to decode into struct, %v", err)
-		return err
+// SetAPIKey replaces the pagerduty API key when it is rotated
+func (client *Client) SetAPIKey(apiKey string) {
+	client.keysMutex.Lock()
+	defer client.keysMutex.Unlock()
+
+	client.APIKey = apiKey
+	// Before Setup the key is only stored
+	if client.provider != nil {
+		client.rotateProvider()
 	}
+}
 
-	return nil
+// SetOpsgenieAPIKey replaces the opsgenie API key when it is rotated
+func (client *Client) SetOpsgenieAPIKey(apiKey string) {
+	client.keysMutex.Lock()
+	defer client.keysMutex.Unlock()
+
+	client.OpsgenieAPIKey = apiKey
+	if client.provider != nil {
+		client.rotateProvider()
+	}
 }
 
-func (client *Client) GetCurrentOnCallUsersMessage() string {
-	onCallMessage := "Currently on call:\n"
+// rotateProvider sets up the provider again with the rotated keys, the keys mutex must be held.
+// When that fails the current provider is kept, it goes on with the old key until the next rotation.
+func (client *Client) rotateProvider() {
+	if err := client.setupProvider(); err != nil {
+		logrus.WithError(err).Error("Could not set up the on-call provider with the rotated API key, keeping the current one")
+	}
+}
+
+func (client *Client) pagerduty() *pagerduty.Client {
+	client.keysMutex.RLock()
+	defer client.keysMutex.RUnlock()
+	return client.pagerdutyClient
+}
 
-	var users []pagerduty.User
+func (client *Client) onCallProvider() OnCallProvider {
+	client.keysMutex.RLock()
+	defer client.keysMutex.RUnlock()
+	return client.provider
+}
+
+func (client *Client) pagerdutyAPIKey() string {
+	client.keysMutex.RLock()
+	defer client.keysMutex.RUnlock()
+	return client.APIKey
+}
+
+// OnCallUser is a user that is currently on call in a schedule
+type OnCallUser struct {
+	pagerduty.User
+	Schedule pagerduty.Schedule
+}
 
-	// For now, do not fetch new data every time this function is called. New data is fetched every 10 minutes in main.go to update this data.
-	if len(client.onCallUsers) > 0 {
-		users = client.onCallUsers
-	} else {
-		users = client.GetCurrentOnCallUsers()
+// GetCurrentOnCallUsersMessage returns who is on call right now.
+// If teamQuery is not empty only the teams and schedules matching it are listed.
+// When the provider can't be reached the last known on-call users are listed, an error is only returned if there are none.
+func (client *Client) GetCurrentOnCallUsersMessage(teamQuery string) (string, error) {
+
+	snapshot, err := client.cachedOnCallUsers()
+	if err != nil {
+		return "", err
+	}
+	users := snapshot.users
+
+	onCallMessage := "Currently on call:\n"
+	if snapshot.refreshErr != nil {
+		onCallMessage = fmt.Sprintf("%s is unreachable, last known on call as of %s:\n", client.onCallProvider().Name(), snapshot.updated.Format("15:04"))
+	}
+
+	if teamQuery != "" {
+		users = filterOnCallUsersByTeam(users, teamQuery)
+		if len(users) == 0 {
+			return fmt.Sprintf("I couldn't find anyone on call for a team or schedule matching '%s'.", teamQuery), nil
+		}
 	}
 
 	for _, user := range users {
-		if len(user.Teams) > 0 {
-			onCallMessage = onCallMessage + user.Teams[0].APIObject.Summary + ": "
+		onCallMessage = onCallMessage + user.Schedule.Name + ": " + client.formatUserName(user.User) + " - " + client.extractContactAddressFromContactMethods(user.ContactMethods, "phone_contact_method")
+		if teamNames := userTeamNames(user.User); len(teamNames) > 0 {
+			onCallMessage = onCallMessage + " (" + strings.Join(teamNames, ", ") + ")"
 		}
-		onCallMessage = onCallMessage + user.Name + " - " + client.extractContactAddressFromContactMethods(user.ContactMethods, "phone_contact_method") + "\n"
+		onCallMessage = onCallMessage + "\n"
 	}
+	onCallMessage = onCallMessage + fmt.Sprintf("_Last updated %s_", snapshot.updated.Format("15:04"))
+
+	return onCallMessage, nil
+}
 
-	return onCallMessage
+// OnCallUsers returns the users on call as of the last refresh
+func (client *Client) OnCallUsers() []OnCallUser {
+	return client.onCall.snapshot().users
 }
 
-func (client *Client) GetCurrentOnCallUsers() []pagerduty.User {
+// IsReportChannel reports whether the monthly report and fairness reports may be sent to a slack channel
+func (client *Client) IsReportChannel(channelID string) bool {
+	client.reportChannelsMutex.RLock()
+	defer client.reportChannelsMutex.RUnlock()
+	return helpers.ArrayContainsString(client.ReportChannels, channelID)
+}
 
-	client.getAllSchedules(false)
+// GetReportChannels returns the slack channels the monthly report is sent to
+func (client *Client) GetReportChannels() []string {
+	client.reportChannelsMutex.RLock()
+	defer client.reportChannelsMutex.RUnlock()
+	return client.ReportChannels
+}
+
+// SetReportChannels swaps the report channels for those of a reloaded config
+func (client *Client) SetReportChannels(reportChannels []string) {
+	client.reportChannelsMutex.Lock()
+	defer client.reportChannelsMutex.Unlock()
+	client.ReportChannels = reportChannels
+}
 
-	var onCallUsers []pagerduty.User
+// TeamForChannel returns the team configured in channel_teams for a slack channel
+func (client *Client) TeamForChannel(channelID string) string {
+	// Viper lowercases map keys, slack channel IDs are uppercase
+	for configChannelID, team := range client.ChannelTeams {
+		if strings.EqualFold(configChannelID, channelID) {
+			return team
+		}
+	}
+	return ""
+}
 
-	for _, schedule := range client.Schedules {
-		var onCallOpts pagerduty.ListOnCallUsersOptions
-		var currentTime = time.Now()
-		onCallOpts.Since = currentTime.Format("2006-01-02T15:04:05Z07:00")
-		hours, _ := time.ParseDuration("1s")
-		onCallOpts.Until = currentTime.Add(hours).Format("2006-01-02T15:04:05Z07:00")
+// IsUserOnCall reports whether the user with the given ID is currently on call
+func (client *Client) IsUserOnCall(userID string) (bool, error) {
 
-		if eps, err := client.pagerdutyClient.ListOnCallUsers(schedule.ID, onCallOpts); err != nil {
-			panic(err)
-		} else {
-			for _, user := range eps {
-				user = client.getUserInfo(user.ID)
-				user.ContactMethods = client.GetUserContactMethods(user.ID)
-				onCallUsers = append(onCallUsers, user)
-			}
+	snapshot, err := client.cachedOnCallUsers()
+	if err != nil {
+		return false, err
+	}
+
+	for _, user := range snapshot.users {
+		if user.ID == userID {
+			return true, nil
 		}
 	}
-	client.onCallUsers = onCallUsers
-	return onCallUsers
+	return false, nil
 }
 
-func (client *Client) listOncallUsers(scheduleId string, from time.Time, until time.Time) []pagerduty.User {
+// GetUpcomingShiftsMessage returns a message listing the on-call shifts of the given user between now and until
+func (client *Client) GetUpcomingShiftsMessage(userID string, until time.Time) (string, error) {
+
+	location, _ := time.LoadLocation("Europe/Amsterdam")
+
+	shifts, err := client.onCallProvider().UserShifts(userID, time.Now(), until)
+	if err != nil {
+		return "", err
+	}
+
+	var shiftLines string
+	for _, shift := range shifts {
+		shiftLines = shiftLines + fmt.Sprintf("%s - %s: %s\n", shift.Start.In(location).Format("Mon 2006-01-02 15:04"), shift.End.In(location).Format("Mon 2006-01-02 15:04"), shift.Schedule.Summary)
+	}
+
+	if shiftLines == "" {
+		return fmt.Sprintf("You have no on-call shifts until %s.", until.In(location).Format("2006-01-02")), nil
+	}
+	return "Your upcoming on-call shifts:\n" + shiftLines, nil
+}
+
+// ListAllUsers returns every user of the on-call provider
+func (client *Client) ListAllUsers() ([]pagerduty.User, error) {
+	return client.onCallProvider().Users()
+}
+
+// ListPagerdutyUsers returns every pagerduty user, also when the schedules are read from another provider.
+// Without a pagerduty API key there are none.
+func (client *Client) ListPagerdutyUsers() ([]pagerduty.User, error) {
+	if client.UsesPagerduty() {
+		return client.onCallProvider().Users()
+	}
+	if client.pagerdutyAPIKey() == "" {
+		return nil, nil
+	}
+	return newPagerdutyProvider(client.pagerduty(), client).Users()
+}
+
+// ProviderName is the name of the on-call provider, for messages
+func (client *Client) ProviderName() string {
+	return client.onCallProvider().Name()
+}
+
+func (client *Client) formatUserName(user pagerduty.User) string {
+	if client.FormatUserName != nil {
+		return client.FormatUserName(user)
+	}
+	return user.Name
+}
+
+// GetCurrentOnCallUsers fetches the users that are on call right now and stores them in the cache.
+// If this fails the users of the last successful refresh are kept.
+func (client *Client) GetCurrentOnCallUsers() ([]OnCallUser, error) {
+
+	onCallUsers, err := client.onCallProvider().CurrentOnCall()
+	client.onCall.store(onCallUsers, err)
+	if err != nil {
+		return nil, err
+	}
+	return onCallUsers, nil
+}
+
+func (client *Client) listOncallUsers(scheduleId string, from time.Time, until time.Time) ([]pagerduty.User, error) {
 
 	var onCallOpts pagerduty.ListOnCallUsersOptions
 	onCallOpts.Since = from.In(time.UTC).Format("2006-01-02T15:04:05Z07:00")
 	onCallOpts.Until = until.In(time.UTC).Format("2006-01-02T15:04:05Z07:00")
 
-	if users, err := client.pagerdutyClient.ListOnCallUsers(scheduleId, onCallOpts); err != nil {
-		panic(err)
-	} else {
-		fmt.Println(users)
-		return users
+	return client.pagerduty().ListOnCallUsers(scheduleId, onCallOpts)
+}
+
+// GetOnCallScheduleMessage returns for every day in dateRange who is on call in each schedule.
+// If teamQuery is not empty only the teams and schedules matching it are listed.
+func (client *Client) GetOnCallScheduleMessage(dateRange dates.DateRange, teamQuery string) (string, error) {
+
+	shifts, err := client.onCallProvider().Shifts(dateRange.From, dateRange.Until)
+	if err != nil {
+		return "", err
+	}
+
+	schedules := shiftSchedules(shifts)
+	if teamQuery != "" {
+		schedules = client.filterSchedulesByTeam(schedules, teamQuery)
+		if len(schedules) == 0 {
+			return fmt.Sprintf("I couldn't find a team or schedule matching '%s'.", teamQuery), nil
+		}
+	}
+
+	onCallMessage := fmt.Sprintf("On call from %s until %s:\n", dateRange.From.Format("2006-01-02"), dateRange.Until.AddDate(0, 0, -1).Format("2006-01-02"))
+
+	for _, day := range dateRange.Days() {
+		dayEnd := day.AddDate(0, 0, 1)
+		onCallMessage = onCallMessage + fmt.Sprintf("\n*%s*\n", day.Format("Monday 2006-01-02"))
+
+		for _, schedule := range schedules {
+			var dayShifts []string
+
+			for _, shift := range shifts {
+				if shift.Schedule.ID != schedule.ID {
+					continue
+				}
+
+				shiftStart := shift.Start.In(day.Location())
+				shiftEnd := shift.End.In(day.Location())
+				if !shiftStart.Before(dayEnd) || !shiftEnd.After(day) {
+					continue
+				}
+
+				// Mention the handover time when the shift does not span the entire day
+				dayShift := client.formatUserName(pagerduty.User{APIObject: shift.User, Name: shift.User.Summary})
+				if shiftStart.After(day) {
+					dayShift = dayShift + " from " + shiftStart.Format("15:04")
+				}
+				if shiftEnd.Before(dayEnd) {
+					dayShift = dayShift + " until " + shiftEnd.Format("15:04")
+				}
+				dayShifts = append(dayShifts, dayShift)
+			}
+
+			if len(dayShifts) > 0 {
+				onCallMessage = onCallMessage + schedule.Summary + ": " + strings.Join(dayShifts, ", ") + "\n"
+			}
+		}
 	}
+
+	return onCallMessage, nil
 }
 
-func (client *Client) listOncalls(from time.Time, until time.Time, scheduleIds ...string) []pagerduty.OnCall {
+// Shift is a period in which a user is on call in a schedule
+type Shift struct {
+	Schedule pagerduty.APIObject
+	User     pagerduty.APIObject
+	Start    time.Time
+	End      time.Time
+}
 
-	var onCallOpts pagerduty.ListOnCallOptions
-	onCallOpts.Since = from.In(time.UTC).Format("2006-01-02T15:04:05Z07:00")
-	onCallOpts.Until = until.In(time.UTC).Format("2006-01-02T15:04:05Z07:00")
-	onCallOpts.ScheduleIDs = scheduleIds
+// ListShifts returns the shifts of all schedules that overlap the period between from and until
+func (client *Client) ListShifts(from time.Time, until time.Time) ([]Shift, error) {
+	return client.onCallProvider().Shifts(from, until)
+}
+
+// ListTeamShifts returns the shifts between from and until of the schedules that match teamQuery
+func (client *Client) ListTeamShifts(teamQuery string, from time.Time, until time.Time) ([]Shift, error) {
 
-	if listOnCallResponse, err := client.pagerdutyClient.ListOnCalls(onCallOpts); err != nil {
-		panic(err)
-	} else {
-		return listOnCallResponse.OnCalls
+	shifts, err := client.onCallProvider().Shifts(from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	teamScheduleIDs := make(map[string]bool)
+	for _, schedule := range client.filterSchedulesByTeam(shiftSchedules(shifts), teamQuery) {
+		teamScheduleIDs[schedule.ID] = true
+	}
+
+	var teamShifts []Shift
+	for _, shift := range shifts {
+		if teamScheduleIDs[shift.Schedule.ID] {
+			teamShifts = append(teamShifts, shift)
+		}
 	}
+	return teamShifts, nil
 }
 
-func (client *Client) CompileScheduleReport() string {
+// shiftSchedules returns the schedules of shifts, sorted by name
+func shiftSchedules(shifts []Shift) []pagerduty.APIObject {
+
+	seen := make(map[string]bool)
+	var schedules []pagerduty.APIObject
+	for _, shift := range shifts {
+		if !seen[shift.Schedule.ID] {
+			seen[shift.Schedule.ID] = true
+			schedules = append(schedules, shift.Schedule)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Summary < schedules[j].Summary })
+	return schedules
+}
 
-	client.getAllSchedules(false)
+// ListUserShifts returns the shifts of a user that overlap the period between from and until,
+// with the start and end cut off at from and until
+func (client *Client) ListUserShifts(userID string, from time.Time, until time.Time) ([]Shift, error) {
+
+	shifts, err := client.onCallProvider().UserShifts(userID, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	var userShifts []Shift
+	for _, shift := range shifts {
+		if !shift.Start.Before(until) || !shift.End.After(from) {
+			continue
+		}
+		if shift.Start.Before(from) {
+			shift.Start = from
+		}
+		if shift.End.After(until) {
+			shift.End = until
+		}
+		userShifts = append(userShifts, shift)
+	}
+	return userShifts, nil
+}
+
+// CreateOverride puts a user on call in a schedule between start and end
+func (client *Client) CreateOverride(scheduleID string, userID string, start time.Time, end time.Time) error {
+
+	if _, ok := client.onCallProvider().(*pagerdutyProvider); !ok {
+		return fmt.Errorf("overrides can only be created in pagerduty, not in %s", client.onCallProvider().Name())
+	}
+
+	override := pagerduty.Override{
+		Start: start.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"),
+		End:   end.In(time.UTC).Format("2006-01-02T15:04:05Z07:00"),
+		User:  pagerduty.APIObject{ID: userID, Type: "user_reference"},
+	}
+
+	_, err := client.pagerduty().CreateOverride(scheduleID, override)
+	return err
+}
+
+// ChannelForTeam returns the slack channel in channel_teams whose team matches the name of a team or schedule
+func (client *Client) ChannelForTeam(name string) string {
+	for channelID, team := range client.ChannelTeams {
+		if helpers.FuzzyMatch(team, name) {
+			// Viper lowercases map keys, slack channel IDs are uppercase
+			return strings.ToUpper(channelID)
+		}
+	}
+	return ""
+}
+
+func (client *Client) CompileScheduleReport() (string, error) {
 
 	location, _ := time.LoadLocation("Europe/Amsterdam")
 
 	nowTime := time.Now()
 	untilTime := time.Date(nowTime.Year(), nowTime.Month(), 18, 11, 01, 0, 0, location)
 	fromTime := untilTime.AddDate(0, -1, 0).Add(time.Minute)
-	fmt.Println(fromTime, untilTime)
+	logrus.WithFields(logrus.Fields{"from": fromTime, "until": untilTime}).Debug("Compiling the on-call report")
 
-	// Loop through the schedules and pass them along listOnCalls so we get schedule information back from the API
-	var scheduleIds []string
-	for _, schedule := range client.Schedules {
-		scheduleIds = append(scheduleIds, schedule.ID)
+	// Get all on call information from the provider: User, Schedule and Start/End dates
+	shifts, err := client.onCallProvider().Shifts(fromTime, untilTime)
+	if err != nil {
+		return "", err
 	}
 
-	// Get all on call information from pagerduty API: User, Schedule and Start/End dates
-	onCalls := client.listOncalls(fromTime, untilTime, scheduleIds...)
-
 	formattedReport := fmt.Sprintf("The following people have been on call:\n\nTimeline from %s to %s:\n", fromTime.Format("2006-01-02 15:04"), untilTime.Format("2006-01-02 15:04"))
 
 	// Calculate the compensation for each onCall and add it to the formattedReport
-	for _, onCall := range onCalls {
+	for _, shift := range shifts {
 
-		scheduleStart := dates.StringToDate(onCall.Start, dates.StringToDateOptions{"2006-01-02T15:04:05Z07:00"}).In(location)
-		scheduleEnd := dates.StringToDate(onCall.End, dates.StringToDateOptions{"2006-01-02T15:04:05Z07:00"}).In(location)
+		scheduleStart := shift.Start.In(location)
+		scheduleEnd := shift.End.In(location)
 
-		// Note that the onCall.Start of a schedule can start _before_ the 'fromTime'.
+		// Note that the shift.Start of a schedule can start _before_ the 'fromTime'.
 		// In order for the pagerduty shift to be outpayed the END date needs to be before the 'untilTime'
 		// This way we never outpay onCall shifts double because they overlap the 'fromTime' or 'untilTime'
 		if scheduleEnd.Before(untilTime) {
@@ -162,30 +486,19 @@ func (client *Client) CompileScheduleReport() string {
 			compensationPerWeek := 250.00
 			calculatedCompensation := weekUnits * compensationPerWeek
 
-			reportLine := fmt.Sprintf("%s - %s: %s for %0.2f hours, that's %f week(s) = €%0.2f\n", scheduleStart.Format("2006-01-02 15:04"), scheduleEnd.Format("2006-01-02 15:04"), onCall.User.Summary, onCallDuration.Hours(), weekUnits, calculatedCompensation)
+			reportLine := fmt.Sprintf("%s - %s: %s for %0.2f hours, that's %f week(s) = €%0.2f\n", scheduleStart.Format("2006-01-02 15:04"), scheduleEnd.Format("2006-01-02 15:04"), shift.User.Summary, onCallDuration.Hours(), weekUnits, calculatedCompensation)
 			formattedReport = formattedReport + reportLine
 
 		}
 	}
 	formattedReport = formattedReport + "\nNote that _only_ the schedules that _end_ within this window are listed. Any on-call schedules exceeding this window will be taken into consideration next month."
 
-	return formattedReport
+	return formattedReport, nil
 }
 
-func (client *Client) getUserInfo(userID string) pagerduty.User {
-	if user, err := client.pagerdutyClient.GetUser(userID, pagerduty.GetUserOptions{}); err != nil {
-		panic(err)
-	} else {
-		return *user
-	}
-}
-
-func (client *Client) GetUserContactMethods(userID string) []pagerduty.ContactMethod {
-	if contactMethodResponse, err := client.pagerdutyClient.GetUserContactMethod(userID); err != nil {
-		panic(err)
-	} else {
-		return contactMethodResponse.ContactMethods
-	}
+// GetUserContactMethods returns how a user of the on-call provider can be reached
+func (client *Client) GetUserContactMethods(userID string) ([]pagerduty.ContactMethod, error) {
+	return client.onCallProvider().ContactMethods(userID)
 }
 
 func (client *Client) extractContactAddressFromContactMethods(userContactMethods []pagerduty.ContactMethod, contactType string) string {
@@ -198,46 +511,3 @@ func (client *Client) extractContactAddressFromContactMethods(userContactMethods
 	}
 	return ""
 }
-
-func (client *Client) updatePagerdutyChannels() {
-
-	for _, schedule := range client.Schedules {
-		fmt.Println(schedule.FinalSchedule)
-	}
-}
-
-func (client *Client) getAllSchedules(withDetail bool) {
-	var c chan pagerduty.Schedule = make(chan pagerduty.Schedule)
-	client.getScheduleList()
-
-	if withDetail {
-		for _, schedule := range client.Schedules {
-			go client.getSchedule(schedule, c)
-		}
-		client.storeSchedules(c)
-	}
-}
-
-func (client *Client) storeSchedules(c <-chan pagerduty.Schedule) {
-	for i, _ := range client.Schedules {
-		schedule := <-c
-		client.Schedules[i] = schedule
-	}
-}
-
-func (client *Client) getScheduleList() {
-	if eps, err := client.pagerdutyClient.ListSchedules(pagerduty.ListSchedulesOptions{}); err != nil {
-		panic(err)
-	} else {
-		client.Schedules = eps.Schedules
-	}
-}
-
-func (client *Client) getSchedule(schedule pagerduty.Schedule, c chan<- pagerduty.Schedule) {
-
-	if schedule, err := client.pagerdutyClient.GetSchedule(schedule.ID, pagerduty.GetScheduleOptions{}); err != nil {
-		log.Fatal(err)
-	} else {
-		c <- *schedule
-	}
-}
@@ -0,0 +1,61 @@
+package schedules
+
+import (
+	"github.com/wvdeutekom/go-pagerduty"
+	"github.com/wvdeutekom/molliebot/helpers"
+)
+
+// filterOnCallUsersByTeam returns the users whose schedule or one of whose teams matches teamQuery
+func filterOnCallUsersByTeam(users []OnCallUser, teamQuery string) []OnCallUser {
+
+	var filteredUsers []OnCallUser
+	for _, user := range users {
+		if helpers.FuzzyMatch(teamQuery, user.Schedule.Name) || userInMatchingTeam(user.User, teamQuery) {
+			filteredUsers = append(filteredUsers, user)
+		}
+	}
+	return filteredUsers
+}
+
+// filterSchedulesByTeam returns the schedules whose name matches teamQuery.
+// Schedules don't list their teams, so a schedule also matches when someone
+// on call in it right now is a member of a matching team.
+func (client *Client) filterSchedulesByTeam(schedules []pagerduty.APIObject, teamQuery string) []pagerduty.APIObject {
+
+	teamScheduleIDs := make(map[string]bool)
+	for _, user := range client.OnCallUsers() {
+		if userInMatchingTeam(user.User, teamQuery) {
+			teamScheduleIDs[user.Schedule.ID] = true
+		}
+	}
+
+	var filteredSchedules []pagerduty.APIObject
+	for _, schedule := range schedules {
+		if helpers.FuzzyMatch(teamQuery, schedule.Summary) || teamScheduleIDs[schedule.ID] {
+			filteredSchedules = append(filteredSchedules, schedule)
+		}
+	}
+	return filteredSchedules
+}
+
+func userInMatchingTeam(user pagerduty.User, teamQuery string) bool {
+	for _, teamName := range userTeamNames(user) {
+		if helpers.FuzzyMatch(teamQuery, teamName) {
+			return true
+		}
+	}
+	return false
+}
+
+func userTeamNames(user pagerduty.User) []string {
+	var teamNames []string
+	for _, team := range user.Teams {
+		// Teams included in a user are references, the name is in the summary
+		if team.Name != "" {
+			teamNames = append(teamNames, team.Name)
+		} else {
+			teamNames = append(teamNames, team.APIObject.Summary)
+		}
+	}
+	return teamNames
+}
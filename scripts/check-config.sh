@@ -0,0 +1,15 @@
+#!/bin/bash
+# Checks config.json and the config in the kubernetes ConfigMap with the molliebot image, e.g. in CI
+
+set -e
+cd ../$( dirname "$0" )
+
+IMAGE_NAME=${IMAGE_NAME:-'wvdeutekom/molliebot:latest'}
+CONFIG_DIR=$(mktemp -d)
+trap "rm -rf $CONFIG_DIR" EXIT
+
+cp config.json $CONFIG_DIR/config.json
+# The config is the indented block after 'config-json: |'
+awk '/config-json: \|/{found=1; next} found && /^    /{print; next} found{exit}' kubernetes/resources.yml > $CONFIG_DIR/configmap.json
+
+docker run --rm -v $CONFIG_DIR:/config $IMAGE_NAME /gopath/bin/molliebot config check /config/config.json /config/configmap.json
@@ -31,4 +31,7 @@ fi
 IMAGE_TAG=$(git rev-parse --short HEAD)
 SLACK_API_KEY=$(echo -n $API_KEY | base64)
 PAGERDUTY_API_KEY=$(echo -n $PAGERDUTY_API_KEY | base64)
+PAGERDUTY_WEBHOOK_SECRET=$(echo -n ${PAGERDUTY_WEBHOOK_SECRET:-} | base64)
+OPSGENIE_API_KEY=$(echo -n ${OPSGENIE_API_KEY:-} | base64)
+CALENDARS_SECRET=$(echo -n ${CALENDARS_SECRET:-} | base64)
 expenv < ../kubernetes/resources.yml | kubectl --namespace=molliebot-${ENVIRONMENT} apply -f -
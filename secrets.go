@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Secrets reads the API keys and secrets from files and secret stores, and picks up rotated values without a restart.
+// For every secret the first of these is used:
+//   - the flag or MOLLIEBOT_* (or legacy) environment variable, which is never refreshed
+//   - the file in the MOLLIEBOT_*_FILE (or legacy *_FILE) environment variable, like a mounted kubernetes secret
+//   - the key in the vault KV secret at vault.path
+//   - the key in the encrypted file, decrypted with MOLLIEBOT_SECRETS_KEY
+//   - the config file
+//
+// Secrets in vault and the encrypted file are keyed by their setting, like messages.api_token.
+type Secrets struct {
+	// Encrypted JSON file with secrets, see 'molliebot secrets encrypt'
+	File  string      `mapstructure:"file"`
+	Vault vaultConfig `mapstructure:"vault"`
+	// How often the secrets are read again, 0 for the default of 5 minutes
+	RefreshMinutes int `mapstructure:"refresh_minutes"`
+
+	appContext *AppContext
+	// The last values read, by setting
+	values map[string]string
+	// The last values read from vault and the encrypted file, used while they can't be read
+	storeValues map[string]map[string]string
+	mutex       sync.Mutex
+}
+
+type vaultConfig struct {
+	// Vault server, VAULT_ADDR when empty. The token is read from VAULT_TOKEN or the file in VAULT_TOKEN_FILE.
+	Address string `mapstructure:"address"`
+	// Path of the KV secret, like secret/data/molliebot for a version 2 KV engine or secret/molliebot for version 1
+	Path string `mapstructure:"path"`
+}
+
+const (
+	secretsKeyEnv         = envPrefix + "SECRETS_KEY"
+	defaultSecretsRefresh = 5 * time.Minute
+)
+
+// secretSettings are the settings that can be read from secret stores
+var secretSettings = []string{
+	"messages.api_token",
+	"pagerduty.api_key",
+	"pagerduty.opsgenie_api_key",
+	"webhooks.secret",
+	"calendars.secret",
+	"jobs.admin_token",
+}
+
+// secretSetters apply a new value of every secret setting to the running bot
+func (context *AppContext) secretSetters() map[string]func(string) {
+	return map[string]func(string){
+		"messages.api_token":         context.Message.SetApiToken,
+		"pagerduty.api_key":          context.Schedule.SetAPIKey,
+		"pagerduty.opsgenie_api_key": context.Schedule.SetOpsgenieAPIKey,
+		"webhooks.secret":            context.Webhook.SetSecret,
+		"calendars.secret":           context.Calendar.SetSecret,
+		"jobs.admin_token":           context.Job.SetAdminToken,
+	}
+}
+
+// Setup reads the secrets and applies them to the appContext, before the other sections are set up
+func (secrets *Secrets) Setup(appContext *AppContext) error {
+	secrets.appContext = appContext
+	secrets.values = make(map[string]string)
+	return secrets.refresh()
+}
+
+// Watch reads the secrets again every RefreshMinutes, the values of a source that is unreachable are kept
+func (secrets *Secrets) Watch() {
+
+	interval := defaultSecretsRefresh
+	if secrets.RefreshMinutes > 0 {
+		interval = time.Duration(secrets.RefreshMinutes) * time.Minute
+	}
+
+	for range time.Tick(interval) {
+		if err := secrets.refresh(); err != nil {
+			logrus.WithError(err).Warn("Could not refresh all secrets, keeping the current values of the sources that failed")
+		}
+	}
+}
+
+// refresh applies the secrets that changed. When a source fails the others are still applied and the error is returned.
+func (secrets *Secrets) refresh() error {
+
+	secrets.mutex.Lock()
+	defer secrets.mutex.Unlock()
+
+	values, err := secrets.read()
+
+	setters := secrets.appContext.secretSetters()
+	for _, key := range secretSettings {
+		value, found := values[key]
+		if _, known := secrets.values[key]; known && !found {
+			// Forget it, so this is only logged once and the secret is applied again when it comes back
+			logrus.WithField("secret", key).Warn("Secret is no longer in any secret store, keeping the current value until a new one is set")
+			delete(secrets.values, key)
+			continue
+		}
+		if !found || value == secrets.values[key] {
+			continue
+		}
+		if _, known := secrets.values[key]; known {
+			logrus.WithField("secret", key).Info("Secret changed, using the new value")
+		}
+		secrets.values[key] = value
+		setters[key](value)
+	}
+	return err
+}
+
+// read returns the secrets that are not set with a flag or environment variable, from the first source that has them.
+// A source that can't be read is skipped and its last values are used instead, the errors of these sources are returned.
+func (secrets *Secrets) read() (map[string]string, error) {
+
+	var failures []string
+	var stores []map[string]string
+	if secrets.Vault.Path != "" {
+		stores = append(stores, secrets.readStore("vault", secrets.readVault, &failures))
+	}
+	if secrets.File != "" {
+		stores = append(stores, secrets.readStore(secrets.File, func() (map[string]string, error) {
+			return readEncryptedSecrets(secrets.File)
+		}, &failures))
+	}
+
+	values := make(map[string]string)
+	for _, key := range secretSettings {
+		if secrets.setDirectly(key) {
+			continue
+		}
+
+		if path := secretFileEnv(key); path != "" {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				failures = append(failures, err.Error())
+				if value, known := secrets.values[key]; known {
+					values[key] = value
+				}
+				continue
+			}
+			values[key] = strings.TrimSpace(string(content))
+			continue
+		}
+
+		for _, store := range stores {
+			if value, found := store[key]; found {
+				values[key] = value
+				break
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return values, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return values, nil
+}
+
+// readStore returns the values of a secret store, or the last values read from it when it fails
+func (secrets *Secrets) readStore(name string, read func() (map[string]string, error), failures *[]string) map[string]string {
+	values, err := read()
+	if err != nil {
+		*failures = append(*failures, fmt.Sprintf("%s: %v", name, err))
+		return secrets.storeValues[name]
+	}
+	if secrets.storeValues == nil {
+		secrets.storeValues = make(map[string]map[string]string)
+	}
+	secrets.storeValues[name] = values
+	return values
+}
+
+// setDirectly reports whether the secret is set with its flag or environment variable
+func (secrets *Secrets) setDirectly(key string) bool {
+	if _, value := settingEnvValue(key); value != "" {
+		return true
+	}
+	if secrets.appContext.flags != nil {
+		if flag := secrets.appContext.flags.Lookup(strings.Replace(key, "_", "-", -1)); flag != nil && flag.Changed {
+			return true
+		}
+	}
+	return false
+}
+
+// secretFileEnv returns the file in MOLLIEBOT_*_FILE or the legacy *_FILE variable of a secret
+func secretFileEnv(key string) string {
+	if path := os.Getenv(settingEnv(key) + "_FILE"); path != "" {
+		return path
+	}
+	for legacy, legacyKey := range legacyEnv {
+		if legacyKey == key {
+			if path := os.Getenv(legacy + "_FILE"); path != "" {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// readVault reads a KV secret from vault, version 2 secrets have their keys in data.data
+func (secrets *Secrets) readVault() (map[string]string, error) {
+
+	address := secrets.Vault.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if address == "" || token == "" {
+		return nil, fmt.Errorf("secrets.vault.address or VAULT_ADDR and VAULT_TOKEN or VAULT_TOKEN_FILE must be set")
+	}
+
+	request, err := http.NewRequest("GET", strings.TrimRight(address, "/")+"/v1/"+strings.TrimLeft(secrets.Vault.Path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d reading %s", response.StatusCode, secrets.Vault.Path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	values := make(map[string]string)
+	for key, value := range data {
+		if text, ok := value.(string); ok {
+			values[key] = text
+		}
+	}
+	return values, nil
+}
+
+// readEncryptedSecrets decrypts a file written by 'molliebot secrets encrypt'
+func readEncryptedSecrets(path string) (map[string]string, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptSecrets(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of strings: %v", err)
+	}
+	return values, nil
+}
+
+// secretsCipher returns the AES-256-GCM cipher of the base64 key in MOLLIEBOT_SECRETS_KEY or the file in MOLLIEBOT_SECRETS_KEY_FILE
+func secretsCipher() (cipher.AEAD, error) {
+
+	encodedKey := os.Getenv(secretsKeyEnv)
+	if path := os.Getenv(secretsKeyEnv + "_FILE"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encodedKey = string(content)
+	}
+	if encodedKey == "" {
+		return nil, fmt.Errorf("%s or %s_FILE must be set to decrypt the secrets file", secretsKeyEnv, secretsKeyEnv)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes in base64, like the output of 'openssl rand -base64 32'", secretsKeyEnv)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The encrypted file is the base64 of the nonce followed by the sealed JSON
+func encryptSecrets(plaintext []byte) ([]byte, error) {
+
+	gcm, err := secretsCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+func decryptSecrets(content []byte) ([]byte, error) {
+
+	gcm, err := secretsCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("not an encrypted secrets file: %v", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("not an encrypted secrets file")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt, is %s the key it was encrypted with?", secretsKeyEnv)
+	}
+	return plaintext, nil
+}
+
+// runSecretsCommand runs 'molliebot secrets encrypt' or 'molliebot secrets decrypt', from stdin to stdout, and returns the exit code
+func runSecretsCommand(args []string) int {
+
+	if len(args) != 1 || (args[0] != "encrypt" && args[0] != "decrypt") {
+		fmt.Fprintln(os.Stderr, "Usage: molliebot secrets encrypt|decrypt < input > output")
+		return 2
+	}
+
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var output []byte
+	switch args[0] {
+	case "encrypt":
+		var values map[string]string
+		if err := json.Unmarshal(input, &values); err != nil {
+			fmt.Fprintf(os.Stderr, "The secrets must be a JSON object of strings: %v\n", err)
+			return 1
+		}
+		output, err = encryptSecrets(input)
+	case "decrypt":
+		output, err = decryptSecrets(input)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	os.Stdout.Write(output)
+	return 0
+}
+
+func isSecretsCommand() bool {
+	return len(os.Args) > 1 && os.Args[1] == "secrets"
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wvdeutekom/molliebot/schedules"
+)
+
+// setEnv sets an environment variable for a test, call the returned function to restore it
+func setEnv(key string, value string) func() {
+	previous, set := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if set {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// vaultStandIn serves a KV secret at /v1/secret/molliebot, the server must be closed after the test
+func vaultStandIn(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/secret/molliebot" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestReadVault(t *testing.T) {
+
+	defer setEnv("VAULT_TOKEN", "test-token")()
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		token  string
+		values map[string]string
+		err    string
+	}{
+		{"KV version 1", http.StatusOK, `{"data": {"messages.api_token": "xoxb-1", "pagerduty.api_key": "pd-1"}}`, "test-token",
+			map[string]string{"messages.api_token": "xoxb-1", "pagerduty.api_key": "pd-1"}, ""},
+		{"KV version 2", http.StatusOK, `{"data": {"data": {"messages.api_token": "xoxb-2"}, "metadata": {"version": 3}}}`, "test-token",
+			map[string]string{"messages.api_token": "xoxb-2"}, ""},
+		{"KV version 1 with a data key", http.StatusOK, `{"data": {"data": {"nested": "value"}, "webhooks.secret": "secret"}}`, "test-token",
+			map[string]string{"webhooks.secret": "secret"}, ""},
+		{"not found", http.StatusNotFound, `{"errors": []}`, "test-token", nil, "HTTP status 404"},
+		{"wrong token", http.StatusOK, `{}`, "wrong-token", nil, "HTTP status 403"},
+		{"invalid JSON", http.StatusOK, `<html>`, "test-token", nil, "invalid character"},
+	}
+
+	for _, test := range tests {
+		server := vaultStandIn(test.status, test.body)
+		defer server.Close()
+		restore := setEnv("VAULT_TOKEN", test.token)
+
+		secrets := &Secrets{Vault: vaultConfig{Address: server.URL + "/", Path: "/secret/molliebot"}}
+		values, err := secrets.readVault()
+		restore()
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%s: got %v, expected %v", test.name, values, test.values)
+		}
+	}
+
+	defer setEnv("VAULT_ADDR", "")()
+	if _, err := (&Secrets{Vault: vaultConfig{Path: "secret/molliebot"}}).readVault(); err == nil {
+		t.Error("expected an error without a vault address")
+	}
+}
+
+func TestEncryptDecryptSecrets(t *testing.T) {
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	restore := setEnv(secretsKeyEnv, key)
+	defer restore()
+
+	plaintext := []byte(`{"messages.api_token": "xoxb-secret"}`)
+	encrypted, err := encryptSecrets(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte("xoxb-secret")) {
+		t.Error("the secret is readable in the encrypted file")
+	}
+
+	decrypted, err := decryptSecrets(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("got %s after a round trip", decrypted)
+	}
+
+	if again, _ := encryptSecrets(plaintext); bytes.Equal(again, encrypted) {
+		t.Error("encrypting twice gave the same output, the nonce is not random")
+	}
+	if _, err := decryptSecrets([]byte("not base64!")); err == nil {
+		t.Error("expected an error for a file that is not encrypted")
+	}
+
+	os.Setenv(secretsKeyEnv, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32)))
+	if _, err := decryptSecrets(encrypted); err == nil {
+		t.Error("expected an error with the wrong key")
+	}
+	os.Setenv(secretsKeyEnv, base64.StdEncoding.EncodeToString([]byte("too short")))
+	if _, err := encryptSecrets(plaintext); err == nil {
+		t.Error("expected an error for a key that is not 32 bytes")
+	}
+}
+
+// secretsTestContext returns an appContext with the sections the secret setters need
+func secretsTestContext() *AppContext {
+	return &AppContext{
+		Message:  &Messages{},
+		Schedule: &schedules.Client{},
+		Webhook:  &Webhooks{},
+		Calendar: &Calendars{},
+		Job:      &Jobs{},
+	}
+}
+
+func TestReadSecretsPrecedence(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer setEnv(secretsKeyEnv, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))()
+	encrypted, err := encryptSecrets([]byte(`{"messages.api_token": "from-file", "pagerduty.api_key": "from-file", "webhooks.secret": "from-file", "calendars.secret": "from-file"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedFile := filepath.Join(dir, "secrets.enc")
+	ioutil.WriteFile(encryptedFile, encrypted, 0600)
+
+	server := vaultStandIn(http.StatusOK, `{"data": {"messages.api_token": "from-vault", "pagerduty.api_key": "from-vault", "webhooks.secret": "from-vault"}}`)
+	defer server.Close()
+	defer setEnv("VAULT_TOKEN", "test-token")()
+
+	apiKeyFile := filepath.Join(dir, "pagerduty-api-key")
+	ioutil.WriteFile(apiKeyFile, []byte("from-secret-file\n"), 0600)
+	webhookSecretFile := filepath.Join(dir, "webhook-secret")
+	ioutil.WriteFile(webhookSecretFile, []byte("from-legacy-secret-file"), 0600)
+
+	defer setEnv("MOLLIEBOT_PAGERDUTY_API_KEY_FILE", apiKeyFile)()
+	defer setEnv("PAGERDUTY_WEBHOOK_SECRET_FILE", webhookSecretFile)()
+	defer setEnv("MOLLIEBOT_JOBS_ADMIN_TOKEN", "from-env")()
+	defer setEnv("MOLLIEBOT_JOBS_ADMIN_TOKEN_FILE", apiKeyFile)()
+
+	secrets := &Secrets{File: encryptedFile, Vault: vaultConfig{Address: server.URL, Path: "secret/molliebot"}, appContext: secretsTestContext()}
+	values, err := secrets.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"messages.api_token": "from-vault",
+		"pagerduty.api_key":  "from-secret-file",
+		"webhooks.secret":    "from-legacy-secret-file",
+		"calendars.secret":   "from-file",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("got %v, expected %v", values, expected)
+	}
+
+	os.Remove(apiKeyFile)
+	if _, err := secrets.read(); err == nil {
+		t.Error("expected an error when the secret file is missing")
+	}
+}
+
+func TestRefreshSecrets(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "calendars-secret")
+	ioutil.WriteFile(tokenFile, []byte("first"), 0600)
+	defer setEnv("MOLLIEBOT_CALENDARS_SECRET_FILE", tokenFile)()
+
+	appContext := secretsTestContext()
+	secrets := &Secrets{}
+	if err := secrets.Setup(appContext); err != nil {
+		t.Fatal(err)
+	}
+	if appContext.Calendar.secret() != "first" {
+		t.Fatalf("got secret %q after setup", appContext.Calendar.secret())
+	}
+
+	ioutil.WriteFile(tokenFile, []byte("second"), 0600)
+	if err := secrets.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if appContext.Calendar.secret() != "second" {
+		t.Errorf("got secret %q after it was rotated", appContext.Calendar.secret())
+	}
+
+	// A secret that disappears keeps its value
+	os.Unsetenv("MOLLIEBOT_CALENDARS_SECRET_FILE")
+	if err := secrets.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if appContext.Calendar.secret() != "second" {
+		t.Errorf("got secret %q after it disappeared", appContext.Calendar.secret())
+	}
+	if _, known := secrets.values["calendars.secret"]; known {
+		t.Error("the secret that disappeared is still known")
+	}
+}
+
+func TestRefreshSecretsWithFailingSource(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "calendars-secret")
+	ioutil.WriteFile(tokenFile, []byte("first"), 0600)
+	defer setEnv("MOLLIEBOT_CALENDARS_SECRET_FILE", tokenFile)()
+
+	server := vaultStandIn(http.StatusOK, `{"data": {"jobs.admin_token": "from-vault"}}`)
+	defer server.Close()
+	defer setEnv("VAULT_TOKEN", "test-token")()
+
+	appContext := secretsTestContext()
+	secrets := &Secrets{Vault: vaultConfig{Address: server.URL, Path: "secret/molliebot"}}
+	if err := secrets.Setup(appContext); err != nil {
+		t.Fatal(err)
+	}
+
+	// Vault refuses the token, the secret file is still refreshed and the value from vault is kept
+	os.Setenv("VAULT_TOKEN", "expired-token")
+	ioutil.WriteFile(tokenFile, []byte("second"), 0600)
+	if err := secrets.refresh(); err == nil || !strings.Contains(err.Error(), "vault") {
+		t.Errorf("got error %v, expected vault to fail", err)
+	}
+	if appContext.Calendar.secret() != "second" {
+		t.Errorf("got secret %q, expected the secret file to be refreshed", appContext.Calendar.secret())
+	}
+	if secrets.values["jobs.admin_token"] != "from-vault" {
+		t.Errorf("got values %v, expected the value from vault to be kept", secrets.values)
+	}
+
+	// The secret file can't be read, its last value is kept
+	os.Setenv("VAULT_TOKEN", "test-token")
+	os.Remove(tokenFile)
+	if err := secrets.refresh(); err == nil {
+		t.Error("expected an error when the secret file is missing")
+	}
+	if secrets.values["calendars.secret"] != "second" || appContext.Calendar.secret() != "second" {
+		t.Errorf("got values %v, expected the last value of the secret file to be kept", secrets.values)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server is the HTTP server for webhooks and other endpoints of the bot.
+// It only listens when an address is configured.
+type Server struct {
+	Address string `mapstructure:"address"`
+
+	mux        *http.ServeMux
+	httpServer *http.Server
+}
+
+const (
+	// Slow or idle clients can't keep connections open forever.
+	// The calendar feeds ask the on-call provider for the shifts, so writing may take as long as its requests.
+	serverReadTimeout  = 10 * time.Second
+	serverWriteTimeout = time.Minute
+	serverIdleTimeout  = 2 * time.Minute
+	// How long Stop waits for the requests that are being handled
+	serverShutdownTimeout = 10 * time.Second
+)
+
+func (server *Server) Setup() {
+	server.mux = http.NewServeMux()
+}
+
+// Handle registers the handler for the given pattern
+func (server *Server) Handle(pattern string, handler http.HandlerFunc) {
+	server.mux.HandleFunc(pattern, handler)
+}
+
+// Start starts listening and serves the requests in the background
+func (server *Server) Start() error {
+	if server.Address == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", server.Address)
+	if err != nil {
+		return err
+	}
+
+	server.httpServer = &http.Server{
+		Handler:      server.mux,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout:  serverIdleTimeout,
+	}
+	go func(httpServer *http.Server) {
+		logrus.WithField("address", server.Address).Info("Listening")
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+			logrus.WithError(err).Error("The HTTP server stopped")
+		}
+	}(server.httpServer)
+	return nil
+}
+
+// Stop stops listening and waits for the requests that are being handled, for at most serverShutdownTimeout
+func (server *Server) Stop() {
+	if server.httpServer == nil {
+		return
+	}
+
+	shutdownContext, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := server.httpServer.Shutdown(shutdownContext); err != nil {
+		logrus.WithError(err).Warn("Not all HTTP requests were finished when the server was stopped")
+	}
+}
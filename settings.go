@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Every setting of the config file can also be set with an environment variable and a command line flag,
+// named after its key: messages.restricted_channels is MOLLIEBOT_MESSAGES_RESTRICTED_CHANNELS and --messages.restricted-channels.
+// Flags override environment variables, which override the config file.
+//
+// Lists of strings are comma separated. Lists of objects and objects, like lunch.lunches and pagerduty.channel_teams, are JSON.
+
+const envPrefix = "MOLLIEBOT_"
+
+// setting is a key of the config with its environment variable and flag
+type setting struct {
+	key     string
+	env     string
+	flag    string
+	valueOf reflect.Type
+}
+
+// legacyEnv are the environment variables from before MOLLIEBOT_*, they still work
+var legacyEnv = map[string]string{
+	"API_KEY":                     "messages.api_token",
+	"DEBUG":                       "messages.verbose_logging",
+	"RESTRICT_TO_CONFIG_CHANNELS": "messages.restrict_to_config_channels",
+	"PAGERDUTY_API_KEY":           "pagerduty.api_key",
+	"OPSGENIE_API_KEY":            "pagerduty.opsgenie_api_key",
+	"PAGERDUTY_WEBHOOK_SECRET":    "webhooks.secret",
+	"CALENDARS_SECRET":            "calendars.secret",
+}
+
+// settings returns every setting of the AppContext sections, found by their mapstructure tags
+func settings() []setting {
+	return collectSettings(reflect.TypeOf(AppContext{}), "")
+}
+
+func collectSettings(structType reflect.Type, prefix string) []setting {
+
+	var collected []setting
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("mapstructure")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		if tag == ",squash" {
+			collected = append(collected, collectSettings(fieldType, prefix)...)
+			continue
+		}
+
+		key := prefix + tag
+		if fieldType.Kind() == reflect.Struct {
+			collected = append(collected, collectSettings(fieldType, key+".")...)
+			continue
+		}
+
+		collected = append(collected, setting{
+			key:     key,
+			env:     settingEnv(key),
+			flag:    strings.Replace(key, "_", "-", -1),
+			valueOf: fieldType,
+		})
+	}
+	return collected
+}
+
+// settingEnv returns the MOLLIEBOT_* environment variable of a setting
+func settingEnv(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// settingEnvValue returns the environment variable a setting is read from and its value.
+// The legacy variable is used when the MOLLIEBOT_* variable is not set.
+func settingEnvValue(key string) (string, string) {
+	env := settingEnv(key)
+	if value := os.Getenv(env); value != "" {
+		return env, value
+	}
+	for legacy, legacyKey := range legacyEnv {
+		if legacyKey == key {
+			if value := os.Getenv(legacy); value != "" {
+				return legacy, value
+			}
+		}
+	}
+	return env, ""
+}
+
+// isJSON reports whether the setting is set with JSON in environment variables and flags
+func (setting setting) isJSON() bool {
+	switch setting.valueOf.Kind() {
+	case reflect.Map:
+		return true
+	case reflect.Slice:
+		return setting.valueOf.Elem().Kind() != reflect.String
+	}
+	return false
+}
+
+// bindSettings makes config read every setting from its environment variable and flag as well.
+// It returns the problems with the values of the environment variables and flags.
+// The environment is only read, so several configs can be loaded in one process.
+func bindSettings(config *viper.Viper, flags *pflag.FlagSet) []string {
+
+	var problems []string
+	for _, setting := range settings() {
+		flag := flags.Lookup(setting.flag)
+		env, value := settingEnvValue(setting.key)
+
+		if !setting.isJSON() {
+			if setting.valueOf.Kind() == reflect.Bool && value != "" {
+				if _, err := strconv.ParseBool(value); err != nil {
+					problems = append(problems, fmt.Sprintf("%s must be true or false, not '%s'", env, value))
+				}
+			}
+			config.BindEnv(setting.key, env)
+			if flag != nil {
+				config.BindPFlag(setting.key, flag)
+			}
+			continue
+		}
+
+		// Viper can't decode JSON, so the value is decoded here and set when the flag or environment variable is used
+		source := env
+		if flag != nil && flag.Changed {
+			value, source = flag.Value.String(), "--"+setting.flag
+		}
+		if value == "" {
+			continue
+		}
+
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be JSON: %v", source, err))
+			continue
+		}
+		config.Set(setting.key, decoded)
+	}
+	return problems
+}
+
+// settingsFlags returns a flag for every setting, and --config for the location of the config file
+func settingsFlags() *pflag.FlagSet {
+
+	flags := pflag.NewFlagSet("molliebot", pflag.ContinueOnError)
+	flags.String("config", "", "location of the config file, overrides CONFIG_LOCATION and MOLLIEBOT_CONFIG (default ./config.json)")
+
+	for _, setting := range settings() {
+		usage := fmt.Sprintf("overrides %s in the config file and %s", setting.key, setting.env)
+		switch {
+		case setting.isJSON():
+			flags.String(setting.flag, "", usage+", as JSON")
+		case setting.valueOf.Kind() == reflect.Bool:
+			flags.Bool(setting.flag, false, usage)
+		case setting.valueOf.Kind() == reflect.Int:
+			flags.Int(setting.flag, 0, usage)
+		case setting.valueOf.Kind() == reflect.Slice:
+			flags.StringSlice(setting.flag, nil, usage+", comma separated")
+		default:
+			flags.String(setting.flag, "", usage)
+		}
+	}
+	return flags
+}
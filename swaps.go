@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/wvdeutekom/molliebot/dates"
+	"github.com/wvdeutekom/molliebot/schedules"
+)
+
+// Swaps lets people hand over (part of) their on-call shift to someone else.
+// The other person has to accept before the override is created in pagerduty.
+type Swaps struct {
+	pending    map[string]pendingSwap
+	mutex      sync.Mutex
+	appContext *AppContext
+}
+
+type pendingSwap struct {
+	shifts        []schedules.Shift
+	requester     string
+	substitute    string
+	substituteID  string
+	channel       string
+	expires       time.Time
+	dateRangeText string
+}
+
+const swapConfirmationTimeout = 12 * time.Hour
+
+func (swaps *Swaps) Setup(appContext *AppContext) {
+	swaps.appContext = appContext
+	swaps.pending = make(map[string]pendingSwap)
+}
+
+// Request asks the substitute to take over the shifts of the sender of msg in dateRange
+func (swaps *Swaps) Request(msg *slack.MessageEvent, dateRange dates.DateRange, substitute string) {
+
+	if !swaps.appContext.Schedule.UsesPagerduty() {
+		swaps.appContext.Message.SendMessage(fmt.Sprintf("I can only swap shifts in pagerduty, the on-call schedules are in %s. Swap them there instead.", swaps.appContext.Schedule.ProviderName()), msg.Channel)
+		return
+	}
+
+	requesterID, ok := swaps.appContext.Identity.PagerdutyUserID(msg.User)
+	if !ok {
+		swaps.appContext.Message.SendMessage("I don't know who you are in pagerduty. Ask an admin to add you to the identity overrides in my config.", msg.Channel)
+		return
+	}
+
+	substituteID, ok := swaps.appContext.Identity.PagerdutyUserID(substitute)
+	if !ok {
+		swaps.appContext.Message.SendMessage(fmt.Sprintf("I don't know who <@%s> is in pagerduty, so I can't put them on call.", substitute), msg.Channel)
+		return
+	}
+
+	if substitute == msg.User {
+		swaps.appContext.Message.SendMessage("Swapping a shift with yourself? Nice try.", msg.Channel)
+		return
+	}
+
+	dateRangeText := dateRange.From.Format("2006-01-02")
+	if len(dateRange.Days()) > 1 {
+		dateRangeText = dateRangeText + " until " + dateRange.Until.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+
+	// Only the part of the period the requester is actually on call can be swapped
+	shifts, err := swaps.appContext.Schedule.ListUserShifts(requesterID, dateRange.From, dateRange.Until)
+	if err != nil {
+		swaps.appContext.Message.SendPagerdutyMessage("", err, msg.Channel)
+		return
+	}
+	if len(shifts) == 0 {
+		swaps.appContext.Message.SendMessage(fmt.Sprintf("You are not on call on %s, there is nothing to swap.", dateRangeText), msg.Channel)
+		return
+	}
+
+	swaps.mutex.Lock()
+	swaps.removeExpired()
+	code := newConfirmationCode(func(code string) bool {
+		_, pending := swaps.pending[code]
+		return pending
+	})
+	swaps.pending[code] = pendingSwap{
+		shifts:        shifts,
+		requester:     msg.User,
+		substitute:    substitute,
+		substituteID:  substituteID,
+		channel:       msg.Channel,
+		expires:       time.Now().Add(swapConfirmationTimeout),
+		dateRangeText: dateRangeText,
+	}
+	swaps.mutex.Unlock()
+
+	swaps.appContext.Message.SendMessage(fmt.Sprintf("<@%s>, <@%s> asks you to take over their on-call shift:\n%s"+
+		"Reply `mollie accept swap %s` to take it over, or `mollie decline swap %s`.", substitute, msg.User, formatShifts(shifts), code, code), msg.Channel)
+}
+
+// Answer accepts or declines the pending swap with the given code, if the sender of msg is the substitute
+func (swaps *Swaps) Answer(msg *slack.MessageEvent, code string, accept bool) {
+
+	swaps.mutex.Lock()
+	swaps.removeExpired()
+	swap, ok := swaps.pending[code]
+	if ok && swap.substitute == msg.User {
+		delete(swaps.pending, code)
+	}
+	swaps.mutex.Unlock()
+
+	if !ok {
+		swaps.appContext.Message.SendMessage(fmt.Sprintf("There is no swap waiting for an answer with code %s, maybe it expired?", code), msg.Channel)
+		return
+	}
+	if swap.substitute != msg.User {
+		swaps.appContext.Message.SendMessage(fmt.Sprintf("Only <@%s> can answer this swap.", swap.substitute), msg.Channel)
+		return
+	}
+
+	if !accept {
+		swaps.appContext.Message.SendMessage(fmt.Sprintf("<@%s>, <@%s> can't take over your shift on %s.", swap.requester, swap.substitute, swap.dateRangeText), msg.Channel)
+		return
+	}
+
+	var failed []string
+	for _, shift := range swap.shifts {
+		if err := swaps.appContext.Schedule.CreateOverride(shift.Schedule.ID, swap.substituteID, shift.Start, shift.End); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", shift.Schedule.Summary, err))
+		}
+	}
+	if len(failed) > 0 {
+		swaps.appContext.Message.SendMessage("I couldn't create all overrides in pagerduty:\n"+strings.Join(failed, "\n"), msg.Channel)
+		return
+	}
+
+	// Refresh so questions about who is on call are answered with the override
+	go swaps.appContext.Schedule.GetCurrentOnCallUsers()
+
+	swaps.appContext.Message.SendMessage(fmt.Sprintf("Done! <@%s> took over the shift of <@%s>:\n%s", swap.substitute, swap.requester, formatShifts(swap.shifts)), msg.Channel)
+
+	// Let the team know, unless the swap was arranged in the team channel
+	notified := map[string]bool{swap.channel: true}
+	for _, shift := range swap.shifts {
+		teamChannel := swaps.appContext.Schedule.ChannelForTeam(shift.Schedule.Summary)
+		if teamChannel != "" && !notified[teamChannel] {
+			swaps.appContext.Message.SendMessage(fmt.Sprintf("Heads up: <@%s> is on call instead of <@%s> on %s.", swap.substitute, swap.requester, swap.dateRangeText), teamChannel)
+			notified[teamChannel] = true
+		}
+	}
+}
+
+// removeExpired removes swaps that were not answered in time, the mutex must be held
+func (swaps *Swaps) removeExpired() {
+	for code, swap := range swaps.pending {
+		if time.Now().After(swap.expires) {
+			delete(swaps.pending, code)
+		}
+	}
+}
+
+func formatShifts(shifts []schedules.Shift) string {
+	var shiftLines string
+	for _, shift := range shifts {
+		shiftLines = shiftLines + fmt.Sprintf("%s - %s: %s\n", formatShiftTime(shift.Start), formatShiftTime(shift.End), shift.Schedule.Summary)
+	}
+	return shiftLines
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wvdeutekom/molliebot/schedules"
+)
+
+var onCallTopicRegex = regexp.MustCompile(`On call: [^|]*`)
+
+// Topics keeps slack channel topics and user groups in sync with who is on call in a pagerduty schedule
+type Topics struct {
+	Syncs []TopicSync `mapstructure:"sync"`
+
+	// User group ID -> the slack user IDs last set as its members
+	userGroupMembers map[string]string
+	appContext       *AppContext
+}
+
+// TopicSync maps a pagerduty schedule to a slack channel whose topic and/or a user group whose members should list the people on call
+type TopicSync struct {
+	// Name or ID of the pagerduty schedule
+	Schedule  string `mapstructure:"schedule"`
+	Channel   string `mapstructure:"channel"`
+	UserGroup string `mapstructure:"user_group"`
+}
+
+func (topics *Topics) Setup(appContext *AppContext) {
+	topics.appContext = appContext
+	topics.userGroupMembers = make(map[string]string)
+}
+
+// Sync updates the configured topics and user groups with the users that are on call as of the last refresh.
+// Topics and user groups are only changed when the people on call have changed.
+func (topics *Topics) Sync() {
+
+	onCallUsers := topics.appContext.Schedule.OnCallUsers()
+
+	for _, sync := range topics.Syncs {
+		var users []schedules.OnCallUser
+		for _, user := range onCallUsers {
+			if user.Schedule.ID == sync.Schedule || strings.EqualFold(user.Schedule.Name, sync.Schedule) {
+				users = append(users, user)
+			}
+		}
+
+		// Nobody on call usually means pagerduty could not be reached, keep the topic as it is
+		if len(users) == 0 {
+			continue
+		}
+
+		if sync.Channel != "" {
+			topics.syncChannelTopic(sync.Channel, users)
+		}
+		if sync.UserGroup != "" {
+			topics.syncUserGroup(sync.UserGroup, users)
+		}
+	}
+}
+
+func (topics *Topics) syncChannelTopic(channelID string, users []schedules.OnCallUser) {
+
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	onCallTopic := fmt.Sprintf("On call: %s ", strings.Join(names, ", "))
+
+	currentTopic, err := topics.appContext.Message.GetChannelTopic(channelID)
+	if err != nil {
+		logrus.WithError(err).WithField("channel", channelID).Warn("Could not retrieve the topic of the channel")
+		return
+	}
+
+	// Replace the on call part of the topic, or put it in front of the existing topic
+	var newTopic string
+	if onCallTopicRegex.MatchString(currentTopic) {
+		newTopic = onCallTopicRegex.ReplaceAllLiteralString(currentTopic, onCallTopic)
+	} else if currentTopic != "" {
+		newTopic = onCallTopic + "| " + currentTopic
+	} else {
+		newTopic = strings.TrimSpace(onCallTopic)
+	}
+
+	if strings.TrimSpace(newTopic) == strings.TrimSpace(currentTopic) {
+		return
+	}
+
+	if err := topics.appContext.Message.SetChannelTopic(channelID, strings.TrimSpace(newTopic)); err != nil {
+		logrus.WithError(err).WithField("channel", channelID).Warn("Could not set the topic of the channel")
+	}
+}
+
+func (topics *Topics) syncUserGroup(userGroupID string, users []schedules.OnCallUser) {
+
+	var slackUserIDs []string
+	for _, user := range users {
+		if slackUserID, ok := topics.appContext.Identity.SlackUserID(user.ID); ok {
+			slackUserIDs = append(slackUserIDs, slackUserID)
+		}
+	}
+
+	// A user group can't be empty
+	if len(slackUserIDs) == 0 {
+		return
+	}
+
+	members := strings.Join(slackUserIDs, ",")
+	if topics.userGroupMembers[userGroupID] == members {
+		return
+	}
+
+	if _, err := topics.appContext.Message.slackClient().UpdateUserGroupMembers(userGroupID, members); err != nil {
+		logrus.WithError(err).WithField("user_group", userGroupID).Warn("Could not update the members of the user group")
+		return
+	}
+	topics.userGroupMembers[userGroupID] = members
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// configKind is the JSON type a setting must have
+type configKind string
+
+const (
+	kindObject    configKind = "an object"
+	kindArray     configKind = "an array"
+	kindStringMap configKind = "an object of strings"
+	kindString    configKind = "a string"
+	kindNumber    configKind = "a number"
+	kindBool      configKind = "true or false"
+)
+
+// configSetting describes a setting of the config file. In paths [] stands for every element of an array.
+type configSetting struct {
+	kind     configKind
+	required bool
+	check    func(value interface{}) string
+}
+
+// configSchema lists every setting of the config file, settings that are not in it are reported as unknown
+var configSchema = map[string]configSetting{
+	"pagerduty":                                  {kind: kindObject},
+	"pagerduty.report_channels":                  {kind: kindArray},
+	"pagerduty.report_channels[]":                {kind: kindString, check: checkNotEmpty},
+	"pagerduty.channel_teams":                    {kind: kindStringMap},
+	"pagerduty.on_call_ttl_minutes":              {kind: kindNumber, check: checkNotNegative},
+	"pagerduty.page_targets":                     {kind: kindArray},
+	"pagerduty.page_targets[]":                   {kind: kindObject},
+	"pagerduty.page_targets[].name":              {kind: kindString, required: true, check: checkNotEmpty},
+	"pagerduty.page_targets[].service":           {kind: kindString, required: true, check: checkNotEmpty},
+	"pagerduty.page_targets[].escalation_policy": {kind: kindString},
+	"pagerduty.holidays":                         {kind: kindArray},
+	"pagerduty.holidays[]":                       {kind: kindString, check: checkDate},
+	"pagerduty.provider":                         {kind: kindString, check: checkProvider},
+	"pagerduty.opsgenie_url":                     {kind: kindString, check: checkURL},
+	"pagerduty.rota_file":                        {kind: kindString},
+	"pagerduty.api_key":                          {kind: kindString},
+	"pagerduty.opsgenie_api_key":                 {kind: kindString},
+	"identities":                                 {kind: kindObject},
+	"identities.overrides":                       {kind: kindStringMap},
+	"identities.on_call_overrides":               {kind: kindStringMap},
+	"handovers":                                  {kind: kindObject},
+	"handovers.enabled":                          {kind: kindBool},
+	"handovers.channel":                          {kind: kindString},
+	"handovers.reminder_hours":                   {kind: kindNumber, check: checkNotNegative},
+	"topics":                                     {kind: kindObject},
+	"topics.sync":                                {kind: kindArray},
+	"topics.sync[]":                              {kind: kindObject},
+	"topics.sync[].schedule":                     {kind: kindString, required: true, check: checkNotEmpty},
+	"topics.sync[].channel":                      {kind: kindString},
+	"topics.sync[].user_group":                   {kind: kindString},
+	"pages":                                      {kind: kindObject},
+	"pages.audit_channel":                        {kind: kindString},
+	"swaps":                                      {kind: kindObject},
+	"http":                                       {kind: kindObject},
+	"http.address":                               {kind: kindString},
+	"webhooks":                                   {kind: kindObject},
+	"webhooks.secret":                            {kind: kindString},
+	"webhooks.service_channels":                  {kind: kindStringMap},
+	"webhooks.default_channel":                   {kind: kindString},
+	"calendars":                                  {kind: kindObject},
+	"calendars.secret":                           {kind: kindString},
+	"calendars.base_url":                         {kind: kindString, check: checkURL},
+	"jobs":                                       {kind: kindObject},
+	"jobs.time_zone":                             {kind: kindString, check: checkTimeZone},
+	"jobs.time_zones":                            {kind: kindStringMap},
+	"jobs.admin_token":                           {kind: kindString},
+	"jobs.history_file":                          {kind: kindString},
+	"jobs.catch_up_hours":                        {kind: kindNumber, check: checkNotNegative},
+	"leader_election":                            {kind: kindObject},
+	"leader_election.backend":                    {kind: kindString, check: checkElectionBackend},
+	"leader_election.lease_name":                 {kind: kindString},
+	"leader_election.namespace":                  {kind: kindString},
+	"leader_election.lock_file":                  {kind: kindString},
+	"leader_election.lease_seconds":              {kind: kindNumber, check: checkNotNegative},
+	"health":                                     {kind: kindObject},
+	"health.max_event_age_minutes":               {kind: kindNumber, check: checkNotNegative},
+	"logging":                                    {kind: kindObject},
+	"logging.format":                             {kind: kindString, check: checkLogFormat},
+	"logging.level":                              {kind: kindString, check: checkLogLevel},
+	"secrets":                                    {kind: kindObject},
+	"secrets.file":                               {kind: kindString},
+	"secrets.refresh_minutes":                    {kind: kindNumber, check: checkNotNegative},
+	"secrets.vault":                              {kind: kindObject},
+	"secrets.vault.address":                      {kind: kindString, check: checkURL},
+	"secrets.vault.path":                         {kind: kindString},
+	"messages":                                   {kind: kindObject, required: true},
+	"messages.restricted_channels":               {kind: kindArray},
+	"messages.restricted_channels[]":             {kind: kindString, check: checkNotEmpty},
+	"messages.notification_times":                {kind: kindArray},
+	"messages.notification_times[]":              {kind: kindString, check: checkCron},
+	"messages.admins":                            {kind: kindArray},
+	"messages.admins[]":                          {kind: kindString, check: checkNotEmpty},
+	"messages.api_token":                         {kind: kindString},
+	"messages.verbose_logging":                   {kind: kindBool},
+	"messages.restrict_to_config_channels":       {kind: kindBool},
+	"lunch":                                      {kind: kindObject, required: true},
+	"lunch.lunches":                              {kind: kindArray},
+	"lunch.lunches[]":                            {kind: kindObject},
+	"lunch.lunches[].date":                       {kind: kindString, required: true, check: checkDate},
+	"lunch.lunches[].description":                {kind: kindString, required: true},
+}
+
+// configProblem is a problem with a setting in the config file
+type configProblem struct {
+	file    string
+	line    int
+	path    string
+	message string
+}
+
+func (problem configProblem) String() string {
+	location := problem.file
+	if problem.line > 0 {
+		location = fmt.Sprintf("%s:%d", problem.file, problem.line)
+	}
+	if problem.path == "" {
+		return fmt.Sprintf("%s: %s", location, problem.message)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, problem.path, problem.message)
+}
+
+// checkConfigFile returns every problem in the config file, in the order they appear in the file
+func checkConfigFile(file string) []configProblem {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []configProblem{{file: file, message: err.Error()}}
+	}
+	return checkConfig(file, content)
+}
+
+func checkConfig(file string, content []byte) []configProblem {
+
+	var config interface{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		problem := configProblem{file: file, message: err.Error()}
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			problem.line = lineAtOffset(content, int(syntaxErr.Offset))
+		}
+		return []configProblem{problem}
+	}
+
+	checker := configChecker{file: file, lines: jsonLines(content)}
+	checker.checkValue(config, "", "")
+
+	// Settings that depend on each other
+	if root, ok := config.(map[string]interface{}); ok {
+		pagerduty, _ := lookupKey(root, "pagerduty").(map[string]interface{})
+		provider, _ := lookupKey(pagerduty, "provider").(string)
+		rotaFile, _ := lookupKey(pagerduty, "rota_file").(string)
+		if provider == "rota" && rotaFile == "" {
+			checker.add("pagerduty.provider", "the rota provider needs pagerduty.rota_file")
+		}
+
+		election, _ := lookupKey(root, "leader_election").(map[string]interface{})
+		backend, _ := lookupKey(election, "backend").(string)
+		lockFile, _ := lookupKey(election, "lock_file").(string)
+		if backend == "file" && lockFile == "" {
+			checker.add("leader_election.backend", "the file backend needs leader_election.lock_file")
+		}
+	}
+
+	sort.Slice(checker.problems, func(i, j int) bool {
+		if checker.problems[i].line != checker.problems[j].line {
+			return checker.problems[i].line < checker.problems[j].line
+		}
+		return checker.problems[i].path < checker.problems[j].path
+	})
+	return checker.problems
+}
+
+type configChecker struct {
+	file     string
+	lines    map[string]int
+	problems []configProblem
+}
+
+func (checker *configChecker) add(path string, message string) {
+	checker.problems = append(checker.problems, configProblem{checker.file, checker.lineOf(path), path, message})
+}
+
+// lineOf returns the line of a setting, or of the closest parent that is in the file
+func (checker *configChecker) lineOf(path string) int {
+	for path != "" {
+		if line, ok := checker.lines[path]; ok {
+			return line
+		}
+		path = parentPath(path)
+	}
+	return 0
+}
+
+// checkValue checks value at path against the schema setting of pattern, the path with [] for array indexes
+func (checker *configChecker) checkValue(value interface{}, path string, pattern string) {
+
+	setting := configSetting{kind: kindObject}
+	if pattern != "" {
+		setting = configSchema[pattern]
+	}
+
+	switch setting.kind {
+	case kindObject:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			checker.add(path, "must be "+string(setting.kind))
+			return
+		}
+		for key, child := range object {
+			// Viper ignores the case of keys
+			childPattern := joinPath(pattern, strings.ToLower(key))
+			if _, known := configSchema[childPattern]; !known {
+				checker.add(joinPath(path, key), "unknown setting")
+				continue
+			}
+			checker.checkValue(child, joinPath(path, key), childPattern)
+		}
+		for _, required := range requiredChildren(pattern) {
+			if lookupKey(object, required) == nil {
+				checker.add(path, fmt.Sprintf("%s is required", joinPath(path, required)))
+			}
+		}
+	case kindArray:
+		array, ok := value.([]interface{})
+		if !ok {
+			checker.add(path, "must be "+string(setting.kind))
+			return
+		}
+		for i, element := range array {
+			checker.checkValue(element, fmt.Sprintf("%s[%d]", path, i), pattern+"[]")
+		}
+	case kindStringMap:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			checker.add(path, "must be "+string(setting.kind))
+			return
+		}
+		for key, child := range object {
+			if _, ok := child.(string); !ok {
+				checker.add(joinPath(path, key), "must be a string")
+			}
+		}
+	case kindString:
+		if _, ok := value.(string); !ok {
+			checker.add(path, "must be "+string(setting.kind))
+			return
+		}
+	case kindNumber:
+		if _, ok := value.(float64); !ok {
+			checker.add(path, "must be "+string(setting.kind))
+			return
+		}
+	case kindBool:
+		if _, ok := value.(bool); !ok {
+			checker.add(path, "must be "+string(setting.kind))
+			return
+		}
+	}
+
+	if setting.check != nil {
+		if message := setting.check(value); message != "" {
+			checker.add(path, message)
+		}
+	}
+}
+
+// requiredChildren returns the keys of the required settings in the object at pattern
+func requiredChildren(pattern string) []string {
+	var required []string
+	for childPattern, setting := range configSchema {
+		if setting.required && parentPath(childPattern) == pattern {
+			required = append(required, strings.TrimPrefix(strings.TrimPrefix(childPattern, pattern), "."))
+		}
+	}
+	sort.Strings(required)
+	return required
+}
+
+func lookupKey(object map[string]interface{}, key string) interface{} {
+	for objectKey, value := range object {
+		if strings.EqualFold(objectKey, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var lastPathElementRegex = regexp.MustCompile(`(\.[^.\[]*|\[\d*\])$`)
+
+func parentPath(path string) string {
+	if !lastPathElementRegex.MatchString(path) {
+		return ""
+	}
+	return lastPathElementRegex.ReplaceAllString(path, "")
+}
+
+func checkNotEmpty(value interface{}) string {
+	if strings.TrimSpace(value.(string)) == "" {
+		return "must not be empty"
+	}
+	return ""
+}
+
+func checkNotNegative(value interface{}) string {
+	if value.(float64) < 0 {
+		return "must not be negative"
+	}
+	return ""
+}
+
+func checkDate(value interface{}) string {
+	if _, err := time.Parse("2006-01-02", value.(string)); err != nil {
+		return fmt.Sprintf("'%s' is not a YYYY-MM-DD date", value)
+	}
+	return ""
+}
+
+func checkCron(value interface{}) string {
+	if _, err := cron.Parse(value.(string)); err != nil {
+		return fmt.Sprintf("'%s' is not a valid cron spec (seconds minutes hours day-of-month month day-of-week): %v", value, err)
+	}
+	return ""
+}
+
+func checkTimeZone(value interface{}) string {
+	if _, err := time.LoadLocation(value.(string)); err != nil {
+		return fmt.Sprintf("'%s' is not a time zone like Europe/Amsterdam", value)
+	}
+	return ""
+}
+
+func checkElectionBackend(value interface{}) string {
+	switch value.(string) {
+	case "", "kubernetes", "file":
+		return ""
+	}
+	return fmt.Sprintf("'%s' is not a leader election backend, use kubernetes or file", value)
+}
+
+func checkLogFormat(value interface{}) string {
+	switch value.(string) {
+	case "", "logfmt", "json":
+		return ""
+	}
+	return fmt.Sprintf("'%s' is not a log format, use logfmt or json", value)
+}
+
+func checkLogLevel(value interface{}) string {
+	switch value.(string) {
+	case "", "debug", "info", "warn", "warning", "error":
+		return ""
+	}
+	return fmt.Sprintf("'%s' is not a log level, use debug, info, warn or error", value)
+}
+
+func checkURL(value interface{}) string {
+	if value.(string) == "" {
+		return ""
+	}
+	if parsedURL, err := url.Parse(value.(string)); err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return fmt.Sprintf("'%s' is not a URL like https://example.com", value)
+	}
+	return ""
+}
+
+func checkProvider(value interface{}) string {
+	switch value.(string) {
+	case "", "pagerduty", "opsgenie", "rota":
+		return ""
+	}
+	return fmt.Sprintf("'%s' is not an on-call provider, use pagerduty, opsgenie or rota", value)
+}
+
+// checkRequiredSettings returns the settings that are missing after reading the config file, environment variables and flags
+func checkRequiredSettings(context *AppContext) []string {
+
+	var problems []string
+	if context.Message.Configuration.ApiToken == "" {
+		problems = append(problems, "messages.api_token must be set to the slack API key, with API_KEY or MOLLIEBOT_MESSAGES_API_TOKEN")
+	}
+	provider := context.Schedule.Provider
+	if (provider == "" || provider == "pagerduty") && context.Schedule.APIKey == "" {
+		problems = append(problems, "pagerduty.api_key must be set to the pagerduty API key, with PAGERDUTY_API_KEY or MOLLIEBOT_PAGERDUTY_API_KEY")
+	}
+	if provider == "opsgenie" && context.Schedule.OpsgenieAPIKey == "" {
+		problems = append(problems, "pagerduty.opsgenie_api_key must be set when pagerduty.provider is opsgenie, with OPSGENIE_API_KEY or MOLLIEBOT_PAGERDUTY_OPSGENIE_API_KEY")
+	}
+	return problems
+}
+
+// runConfigCheck checks the config files in args, or the config file of --config or CONFIG_LOCATION, and returns the exit code
+func runConfigCheck(args []string) int {
+
+	flags := settingsFlags()
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{configLocation(flags)}
+	}
+
+	exitCode := 0
+	for _, file := range files {
+		problems := checkConfigFile(file)
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			exitCode = 1
+		} else {
+			fmt.Printf("%s: ok\n", file)
+		}
+	}
+	return exitCode
+}
+
+// formatProblems returns the problems one per line
+func formatProblems(problems []configProblem) string {
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+	return strings.Join(messages, "\n")
+}
+
+func isConfigCheck() bool {
+	return len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check"
+}
+
+// jsonLines returns the line every value in a JSON document starts on, by path like lunch.lunches[0].date.
+// The document must be valid JSON.
+func jsonLines(content []byte) map[string]int {
+	scanner := jsonLineScanner{content: content, line: 1, lines: make(map[string]int)}
+	scanner.value("")
+	return scanner.lines
+}
+
+type jsonLineScanner struct {
+	content  []byte
+	position int
+	line     int
+	lines    map[string]int
+}
+
+func (scanner *jsonLineScanner) value(path string) {
+
+	scanner.skipWhitespace()
+	if path != "" {
+		scanner.lines[path] = scanner.line
+	}
+	if scanner.position >= len(scanner.content) {
+		return
+	}
+
+	switch scanner.content[scanner.position] {
+	case '{':
+		scanner.position++
+		for {
+			scanner.skipWhitespace()
+			if scanner.position >= len(scanner.content) || scanner.content[scanner.position] == '}' {
+				scanner.position++
+				return
+			}
+			if scanner.content[scanner.position] == ',' {
+				scanner.position++
+				continue
+			}
+			key := scanner.string()
+			scanner.skipWhitespace()
+			// Skip the colon
+			scanner.position++
+			scanner.value(joinPath(path, key))
+		}
+	case '[':
+		scanner.position++
+		for index := 0; ; {
+			scanner.skipWhitespace()
+			if scanner.position >= len(scanner.content) || scanner.content[scanner.position] == ']' {
+				scanner.position++
+				return
+			}
+			if scanner.content[scanner.position] == ',' {
+				scanner.position++
+				continue
+			}
+			scanner.value(fmt.Sprintf("%s[%d]", path, index))
+			index++
+		}
+	case '"':
+		scanner.string()
+	default:
+		// Numbers, true, false and null
+		for scanner.position < len(scanner.content) && !strings.ContainsRune(",]} \t\r\n", rune(scanner.content[scanner.position])) {
+			scanner.position++
+		}
+	}
+}
+
+// string returns the string at the current position
+func (scanner *jsonLineScanner) string() string {
+	start := scanner.position
+	scanner.position++
+	for scanner.position < len(scanner.content) && scanner.content[scanner.position] != '"' {
+		if scanner.content[scanner.position] == '\\' {
+			scanner.position++
+		}
+		scanner.position++
+	}
+	scanner.position++
+
+	var text string
+	if scanner.position <= len(scanner.content) {
+		json.Unmarshal(scanner.content[start:scanner.position], &text)
+	}
+	return text
+}
+
+func (scanner *jsonLineScanner) skipWhitespace() {
+	for scanner.position < len(scanner.content) && strings.ContainsRune(" \t\r\n", rune(scanner.content[scanner.position])) {
+		if scanner.content[scanner.position] == '\n' {
+			scanner.line++
+		}
+		scanner.position++
+	}
+}
+
+func lineAtOffset(content []byte, offset int) int {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	return strings.Count(string(content[:offset]), "\n") + 1
+}
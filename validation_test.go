@@ -0,0 +1,199 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONLines(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		lines   map[string]int
+	}{
+		{
+			"nested objects",
+			`{
+  "messages": {
+    "api_token": "xoxb",
+    "verbose_logging": true
+  },
+  "lunch": {}
+}`,
+			map[string]int{"messages": 2, "messages.api_token": 3, "messages.verbose_logging": 4, "lunch": 6},
+		},
+		{
+			"arrays",
+			`{
+  "messages": {
+    "admins": [
+      "U1",
+      "U2"
+    ],
+    "notification_times": ["0 0 12 * * MON-FRI", "0 30 12 * * *"]
+  }
+}`,
+			map[string]int{"messages": 2, "messages.admins": 3, "messages.admins[0]": 4, "messages.admins[1]": 5,
+				"messages.notification_times": 7, "messages.notification_times[0]": 7, "messages.notification_times[1]": 7},
+		},
+		{
+			"objects in arrays",
+			`{"lunch": {"lunches": [
+  {"date": "2017-12-24",
+   "description": "Christmas"},
+  {
+    "date": "2017-12-31", "description": "New year"
+  }
+]}}`,
+			map[string]int{"lunch": 1, "lunch.lunches": 1, "lunch.lunches[0]": 2, "lunch.lunches[0].date": 2, "lunch.lunches[0].description": 3,
+				"lunch.lunches[1]": 4, "lunch.lunches[1].date": 5, "lunch.lunches[1].description": 5},
+		},
+		{
+			"strings with JSON characters and empty values",
+			`{
+  "pagerduty": {"channel_teams": {"C1": "a \"quoted\" {team}, [with] brackets"},
+    "report_channels": [],
+    "holidays": [
+    ],
+    "on_call_ttl_minutes": 10,
+    "provider": null
+  }
+}`,
+			map[string]int{"pagerduty": 2, "pagerduty.channel_teams": 2, "pagerduty.channel_teams.C1": 2, "pagerduty.report_channels": 3,
+				"pagerduty.holidays": 4, "pagerduty.on_call_ttl_minutes": 6, "pagerduty.provider": 7},
+		},
+	}
+
+	for _, test := range tests {
+		if lines := jsonLines([]byte(test.content)); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: got lines %v, expected %v", test.name, lines, test.lines)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		content  string
+		problems []string
+	}{
+		{
+			"valid",
+			`{
+  "messages": {"api_token": "xoxb", "admins": ["U1"]},
+  "lunch": {"lunches": [{"date": "2017-12-24", "description": "Christmas"}]},
+  "pagerduty": {"channel_teams": {"C1": "Platform"}, "page_targets": [{"name": "payments", "service": "PSERVIC"}]}
+}`,
+			nil,
+		},
+		{
+			"unknown keys",
+			`{
+  "messages": {
+    "api_tokn": "xoxb"
+  },
+  "lunch": {
+    "lunches": [
+      {"date": "2017-12-24", "description": "Christmas", "location": "office"}
+    ]
+  },
+  "lunchh": {}
+}`,
+			[]string{
+				"config.json:3: messages.api_tokn: unknown setting",
+				"config.json:7: lunch.lunches[0].location: unknown setting",
+				"config.json:10: lunchh: unknown setting",
+			},
+		},
+		{
+			"keys in any case",
+			`{"Messages": {"API_Token": "xoxb"}, "lunch": {}}`,
+			nil,
+		},
+		{
+			"wrong types",
+			`{
+  "messages": {
+    "verbose_logging": "yes",
+    "admins": "U1"
+  },
+  "lunch": {
+    "lunches": {"date": "2017-12-24"}
+  },
+  "pagerduty": {
+    "on_call_ttl_minutes": "10",
+    "channel_teams": {
+      "C1": 1
+    },
+    "holidays": [
+      "2017-12-25",
+      26
+    ]
+  }
+}`,
+			[]string{
+				"config.json:3: messages.verbose_logging: must be true or false",
+				"config.json:4: messages.admins: must be an array",
+				"config.json:7: lunch.lunches: must be an array",
+				"config.json:10: pagerduty.on_call_ttl_minutes: must be a number",
+				"config.json:12: pagerduty.channel_teams.C1: must be a string",
+				"config.json:16: pagerduty.holidays[1]: must be a string",
+			},
+		},
+		{
+			"required settings",
+			`{
+  "messages": {},
+  "lunch": {
+    "lunches": [
+      {"date": "2017-12-24", "description": "Christmas"},
+      {
+        "date": "2017-12-31"
+      }
+    ]
+  }
+}`,
+			[]string{"config.json:6: lunch.lunches[1]: lunch.lunches[1].description is required"},
+		},
+		{
+			"missing sections",
+			`{"messages": {}}`,
+			[]string{"config.json: lunch is required"},
+		},
+		{
+			"invalid values",
+			`{
+  "messages": {"admins": [" "]},
+  "lunch": {"lunches": [{"date": "24-12-2017", "description": "Christmas"}]},
+  "pagerduty": {"provider": "rota", "on_call_ttl_minutes": -1}
+}`,
+			[]string{
+				"config.json:2: messages.admins[0]: must not be empty",
+				"config.json:3: lunch.lunches[0].date: '24-12-2017' is not a YYYY-MM-DD date",
+				"config.json:4: pagerduty.on_call_ttl_minutes: must not be negative",
+				"config.json:4: pagerduty.provider: the rota provider needs pagerduty.rota_file",
+			},
+		},
+		{
+			"syntax error",
+			`{
+  "messages": {},
+  "lunch": {,}
+}`,
+			[]string{"config.json:3: invalid character ',' looking for beginning of object key string"},
+		},
+	}
+
+	for _, test := range tests {
+		var problems []string
+		for _, problem := range checkConfig("config.json", []byte(test.content)) {
+			problems = append(problems, problem.String())
+		}
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: got problems\n%s\nexpected\n%s", test.name, strings.Join(problems, "\n"), strings.Join(test.problems, "\n"))
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Webhooks receives pagerduty v3 webhooks and keeps a slack thread per incident up to date
+type Webhooks struct {
+	// Secret of the pagerduty webhook subscription, used to verify the signatures
+	Secret string `mapstructure:"secret"`
+	// Pagerduty service ID -> slack channel ID
+	ServiceChannels map[string]string `mapstructure:"service_channels"`
+	// Channel for services that are not in ServiceChannels, incidents of those services are ignored when empty
+	DefaultChannel string `mapstructure:"default_channel"`
+
+	// Incident ID -> the slack message that started its thread
+	threads    map[string]incidentThread
+	mutex      sync.Mutex
+	appContext *AppContext
+	// The events that still have to be posted, in the order they came in
+	events chan webhookEvent
+
+	// Guards Secret, which is replaced when it is rotated
+	secretMutex sync.RWMutex
+}
+
+type incidentThread struct {
+	channel   string
+	timestamp string
+}
+
+type webhookPayload struct {
+	Event webhookEvent `json:"event"`
+}
+
+type webhookEvent struct {
+	ID           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	OccurredAt   string          `json:"occurred_at"`
+	Agent        *webhookObject  `json:"agent"`
+	Data         webhookIncident `json:"data"`
+}
+
+type webhookObject struct {
+	ID      string `json:"id"`
+	Summary string `json:"summary"`
+	HTMLURL string `json:"html_url"`
+}
+
+type webhookIncident struct {
+	ID        string          `json:"id"`
+	Number    uint            `json:"number"`
+	Title     string          `json:"title"`
+	Status    string          `json:"status"`
+	Urgency   string          `json:"urgency"`
+	HTMLURL   string          `json:"html_url"`
+	Service   webhookObject   `json:"service"`
+	Assignees []webhookObject `json:"assignees"`
+}
+
+const (
+	webhookPath = "/webhooks/pagerduty"
+	// Pagerduty webhook payloads are a few kilobytes
+	maxWebhookBytes = 1 << 20
+	// Events that are waiting to be posted, pagerduty retries the events that don't fit
+	webhookQueueSize = 100
+)
+
+func (webhooks *Webhooks) Setup(appContext *AppContext) {
+	webhooks.appContext = appContext
+	webhooks.threads = make(map[string]incidentThread)
+	webhooks.events = make(chan webhookEvent, webhookQueueSize)
+	appContext.Server.Handle(webhookPath, webhooks.handle)
+}
+
+// Run posts the incoming events to slack one at a time, so the updates of an incident are posted in order
+func (webhooks *Webhooks) Run() {
+	for event := range webhooks.events {
+		webhooks.postEvent(event)
+	}
+}
+
+// SetSecret replaces the secret of the webhook subscription when it is rotated
+func (webhooks *Webhooks) SetSecret(secret string) {
+	webhooks.secretMutex.Lock()
+	defer webhooks.secretMutex.Unlock()
+	webhooks.Secret = secret
+}
+
+func (webhooks *Webhooks) handle(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	if !webhooks.validSignature(body, r.Header.Get("X-PagerDuty-Signature")) {
+		logrus.Warn("Rejected pagerduty webhook with an invalid signature")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	// Pagerduty only waits a few seconds for a response, post to slack in the background
+	if payload.Event.ResourceType == "incident" {
+		select {
+		case webhooks.events <- payload.Event:
+		default:
+			http.Error(w, "too many events waiting", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validSignature checks the X-PagerDuty-Signature header, which contains one or more
+// comma separated 'v1=<hex hmac-sha256 of the body>' signatures during secret rotation
+func (webhooks *Webhooks) validSignature(body []byte, signatureHeader string) bool {
+
+	webhooks.secretMutex.RLock()
+	secret := webhooks.Secret
+	webhooks.secretMutex.RUnlock()
+
+	if secret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	for _, signature := range strings.Split(signatureHeader, ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(signature)), []byte(expected)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (webhooks *Webhooks) postEvent(event webhookEvent) {
+
+	incident := event.Data
+	channel := webhooks.channelForService(incident.Service.ID)
+	if channel == "" {
+		return
+	}
+
+	var update string
+	switch event.EventType {
+	case "incident.triggered":
+		update = "Triggered"
+	case "incident.acknowledged":
+		update = "Acknowledged"
+	case "incident.resolved":
+		update = "Resolved"
+	case "incident.reassigned":
+		update = "Reassigned to " + webhooks.assigneeMentions(incident)
+	default:
+		return
+	}
+	if event.Agent != nil && event.Agent.Summary != "" && event.EventType != "incident.triggered" {
+		update = update + " by " + event.Agent.Summary
+	}
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	summary := webhooks.incidentSummary(incident)
+	thread, ok := webhooks.threads[incident.ID]
+	if !ok {
+		// Start a thread for the incident, this is also done for updates of incidents from before the bot started
+		timestamp, err := webhooks.appContext.Message.PostMessage(summary, channel, "")
+		if err != nil {
+			logrus.WithError(err).WithField("incident", incident.ID).Error("Could not post the incident to slack")
+			return
+		}
+		thread = incidentThread{channel, timestamp}
+		webhooks.threads[incident.ID] = thread
+	} else {
+		// Keep the status in the first message of the thread up to date
+		webhooks.appContext.Message.UpdateMessage(summary, thread.channel, thread.timestamp)
+	}
+
+	if _, err := webhooks.appContext.Message.PostMessage(update, thread.channel, thread.timestamp); err != nil {
+		logrus.WithError(err).WithField("incident", incident.ID).Error("Could not post the update of the incident to slack")
+	}
+
+	if event.EventType == "incident.resolved" {
+		delete(webhooks.threads, incident.ID)
+	}
+}
+
+func (webhooks *Webhooks) channelForService(serviceID string) string {
+	// Viper lowercases map keys, pagerduty IDs are uppercase
+	for configServiceID, channel := range webhooks.ServiceChannels {
+		if strings.EqualFold(configServiceID, serviceID) {
+			return channel
+		}
+	}
+	return webhooks.DefaultChannel
+}
+
+func (webhooks *Webhooks) incidentSummary(incident webhookIncident) string {
+	summary := fmt.Sprintf("*<%s|#%d %s>*\nService: %s | Urgency: %s | Status: *%s*", incident.HTMLURL, incident.Number, incident.Title, incident.Service.Summary, incident.Urgency, incident.Status)
+	if len(incident.Assignees) > 0 {
+		summary = summary + "\nAssigned to: " + webhooks.assigneeMentions(incident)
+	}
+	return summary
+}
+
+func (webhooks *Webhooks) assigneeMentions(incident webhookIncident) string {
+	var mentions []string
+	for _, assignee := range incident.Assignees {
+		if slackUserID, ok := webhooks.appContext.Identity.PagerdutySlackUserID(assignee.ID); ok {
+			mentions = append(mentions, fmt.Sprintf("<@%s>", slackUserID))
+		} else {
+			mentions = append(mentions, assignee.Summary)
+		}
+	}
+	return strings.Join(mentions, ", ")
+}
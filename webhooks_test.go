@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// sign returns the X-PagerDuty-Signature of body with secret
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func incidentEvent(id string, eventType string) []byte {
+	return []byte(fmt.Sprintf(`{"event": {"id": "%s-%s", "event_type": "%s", "resource_type": "incident", "data": {"id": "%s"}}}`, id, eventType, eventType, id))
+}
+
+func postWebhook(webhooks *Webhooks, method string, body []byte, signature string) int {
+	request := httptest.NewRequest(method, webhookPath, bytes.NewReader(body))
+	request.Header.Set("X-PagerDuty-Signature", signature)
+	recorder := httptest.NewRecorder()
+	webhooks.handle(recorder, request)
+	return recorder.Code
+}
+
+func TestWebhookSignatures(t *testing.T) {
+
+	body := incidentEvent("PINC1", "incident.triggered")
+	tooLarge := append(append([]byte(`{"event": {"id": "`), bytes.Repeat([]byte("a"), maxWebhookBytes)...), []byte(`"}}`)...)
+	ping := []byte(`{"event": {"id": "PING", "event_type": "pagey.ping", "resource_type": "pagey"}}`)
+
+	tests := []struct {
+		name      string
+		secret    string
+		method    string
+		body      []byte
+		signature string
+		status    int
+		queued    int
+	}{
+		{"valid signature", "secret", "POST", body, sign("secret", body), http.StatusNoContent, 1},
+		{"rotated secret with several signatures", "new-secret", "POST", body, sign("old-secret", body) + ", " + sign("new-secret", body), http.StatusNoContent, 1},
+		{"signature of another secret", "secret", "POST", body, sign("other-secret", body), http.StatusUnauthorized, 0},
+		{"no signature", "secret", "POST", body, "", http.StatusUnauthorized, 0},
+		{"signature of another body", "secret", "POST", body, sign("secret", []byte("{}")), http.StatusUnauthorized, 0},
+		{"no secret configured", "", "POST", body, sign("", body), http.StatusUnauthorized, 0},
+		{"body that is too large", "secret", "POST", tooLarge, sign("secret", tooLarge), http.StatusBadRequest, 0},
+		{"invalid payload", "secret", "POST", []byte("not json"), sign("secret", []byte("not json")), http.StatusBadRequest, 0},
+		{"event of another resource", "secret", "POST", ping, sign("secret", ping), http.StatusNoContent, 0},
+		{"GET request", "secret", "GET", nil, "", http.StatusMethodNotAllowed, 0},
+	}
+
+	for _, test := range tests {
+		webhooks := &Webhooks{Secret: test.secret, events: make(chan webhookEvent, webhookQueueSize)}
+		if status := postWebhook(webhooks, test.method, test.body, test.signature); status != test.status {
+			t.Errorf("%s: got status %d, expected %d", test.name, status, test.status)
+		}
+		if queued := len(webhooks.events); queued != test.queued {
+			t.Errorf("%s: got %d queued events, expected %d", test.name, queued, test.queued)
+		}
+	}
+}
+
+func TestWebhookEventsInOrder(t *testing.T) {
+
+	// The updates of two incidents, as many as fit in the queue
+	events := [][2]string{
+		{"PINC1", "incident.triggered"},
+		{"PINC2", "incident.triggered"},
+		{"PINC1", "incident.acknowledged"},
+		{"PINC1", "incident.resolved"},
+		{"PINC2", "incident.resolved"},
+	}
+	webhooks := &Webhooks{Secret: "secret", events: make(chan webhookEvent, len(events))}
+	var expected []string
+	for _, event := range events {
+		body := incidentEvent(event[0], event[1])
+		if status := postWebhook(webhooks, "POST", body, sign("secret", body)); status != http.StatusNoContent {
+			t.Fatalf("got status %d for %s of %s", status, event[1], event[0])
+		}
+		expected = append(expected, event[0]+"-"+event[1])
+	}
+
+	// Pagerduty retries the events that don't fit in the queue
+	body := incidentEvent("PINC1", "incident.resolved")
+	if status := postWebhook(webhooks, "POST", body, sign("secret", body)); status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with a full queue", status)
+	}
+
+	// Run posts the queued events one at a time, in the order they came in
+	close(webhooks.events)
+	var got []string
+	for event := range webhooks.events {
+		got = append(got, event.ID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got events %v, expected %v", got, expected)
+	}
+}